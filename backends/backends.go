@@ -1,14 +1,46 @@
 package backends
 
 import (
+	"context"
 	"github.com/3onyc/hipdate/shared"
 )
 
+// Backend applies the routes to a proxy, operations give up once their
+// context is done. Backends holding connections implement io.Closer, they're
+// closed when they're replaced or hipdated stops.
 type Backend interface {
-	AddEndpoint(h shared.Host, e shared.Endpoint) error
-	RemoveEndpoint(h shared.Host, e shared.Endpoint) error
-	ListHosts() (*shared.HostList, error)
-	Initialise() error
+	AddEndpoint(ctx context.Context, h shared.Host, e shared.Endpoint) error
+	RemoveEndpoint(ctx context.Context, h shared.Host, e shared.Endpoint) error
+	ListHosts(ctx context.Context) (*shared.HostList, error)
+	Initialise(ctx context.Context) error
+}
+
+// Change is an endpoint to add to or remove from a host.
+type Change struct {
+	Type     shared.EventKind
+	Host     shared.Host
+	Endpoint shared.Endpoint
+}
+
+// Applier is implemented by backends that prefer applying changes in bulk,
+// like ones writing a config file and reloading a proxy. The changes of the
+// events arriving close together are then passed to Apply at once, instead
+// of calling AddEndpoint and RemoveEndpoint for each of them.
+type Applier interface {
+	Apply(ctx context.Context, cs []Change) error
+}
+
+// Drainer is implemented by backends that can stop sending new connections to
+// an endpoint while letting the current ones finish, before it's removed.
+type Drainer interface {
+	DrainEndpoint(ctx context.Context, h shared.Host, e shared.Endpoint) error
+}
+
+// RouteChecker is implemented by backends that can't route every host,
+// CheckRoute returns why h can't be routed, or nil if it can. Routes a backend
+// can't route are never passed to it.
+type RouteChecker interface {
+	CheckRoute(h shared.Host) error
 }
 
 type BackendInitFunc func(opt shared.OptionMap) (Backend, error)
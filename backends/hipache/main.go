@@ -1,64 +1,179 @@
 package hipache
 
 import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"errors"
 	"github.com/3onyc/hipdate/backends"
 	"github.com/3onyc/hipdate/shared"
 	"github.com/garyburd/redigo/redis"
+	"io/ioutil"
 	"log"
+	"net"
+	"strings"
 )
 
 var (
 	MissingRedisUrlError = errors.New("redis url not specified")
+	InvalidCaError       = errors.New("no certificates found in tls_ca")
+	UnsupportedPathError = errors.New("hipache doesn't support routing by path")
+
+	patternEscaper = strings.NewReplacer(
+		`\`, `\\`, "*", `\*`, "?", `\?`, "[", `\[`, "]", `\]`,
+	)
+)
+
+const (
+	scanCount = 100
 )
 
+// HipacheBackend stores the routes in the redis used by hipache, it's
+// configured through the following options:
+//
+//	redis         redis://[:password@]host[:port][/db], rediss:// for TLS
+//	tls           "true" to use TLS with a redis:// url
+//	tls_ca        CA certificate file to verify the server with
+//	tls_insecure  "true" to skip verifying the server certificate
+//	delete_empty  "true" to delete a frontend once its last endpoint is removed
+//	key_prefix    prepended to the frontend keys, to share a redis
+//
+//	sentinels        comma separated sentinel addresses, the master is looked
+//	                 up through them instead of using the redis url's host
+//	sentinel_master  name of the master to look up
 type HipacheBackend struct {
-	r redis.Conn
+	pool        *redis.Pool
+	prefix      string
+	deleteEmpty string
 }
 
 func NewHipacheBackend(opts shared.OptionMap) (backends.Backend, error) {
 	ru, ok := opts["redis"]
-	if !ok {
+	if !ok && opts["sentinels"] == "" {
 		return nil, MissingRedisUrlError
+	} else if !ok {
+		ru = "redis://"
 	}
 
-	r, err := createRedisConn(ru)
+	rc, err := parseRedisUrl(ru)
 	if err != nil {
 		return nil, err
 	}
 
+	if opts["sentinels"] != "" {
+		if rc.Sentinel, err = newSentinel(opts["sentinel_master"], opts["sentinels"]); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := configureTls(rc, opts); err != nil {
+		return nil, err
+	}
+
+	deleteEmpty := "0"
+	if opts["delete_empty"] == "true" {
+		deleteEmpty = "1"
+	}
+
 	return &HipacheBackend{
-		r: *r,
+		pool:        newRedisPool(rc),
+		prefix:      opts["key_prefix"],
+		deleteEmpty: deleteEmpty,
 	}, nil
 }
 
+func configureTls(rc *redisConfig, opts shared.OptionMap) error {
+	if opts["tls"] == "true" && rc.TLS == nil {
+		h, _, _ := net.SplitHostPort(rc.Addr)
+		rc.TLS = &tls.Config{ServerName: h}
+	}
+
+	if rc.TLS == nil {
+		return nil
+	}
+
+	rc.TLS.InsecureSkipVerify = opts["tls_insecure"] == "true"
+	if ca, ok := opts["tls_ca"]; ok {
+		b, err := ioutil.ReadFile(ca)
+		if err != nil {
+			return err
+		}
+
+		rc.TLS.RootCAs = x509.NewCertPool()
+		if !rc.TLS.RootCAs.AppendCertsFromPEM(b) {
+			return InvalidCaError
+		}
+	}
+
+	return nil
+}
+
+// Close closes the connections to redis.
+func (hb *HipacheBackend) Close() error {
+	return hb.pool.Close()
+}
+
+// CheckRoute rejects hosts with a path, hipache only routes by hostname.
+func (hb *HipacheBackend) CheckRoute(h shared.Host) error {
+	if h.Path() != "" {
+		return UnsupportedPathError
+	}
+
+	return nil
+}
+
 func (hb *HipacheBackend) AddEndpoint(
+	ctx context.Context,
 	h shared.Host,
 	e shared.Endpoint,
 ) error {
-	exists, err := hb.hostExists(h)
-	if err != nil {
-		log.Println(err)
+	if h.Path() != "" {
+		return UnsupportedPathError
 	}
 
-	if !exists {
-		if err := hb.hostCreate(h); err != nil {
-			log.Println(err)
-		}
+	c, err := hb.conn(ctx)
+	if err != nil {
+		return err
 	}
-
-	if _, err := hb.r.Do("RPUSH", prefixKey(h), e.String()); err != nil {
+	defer c.Close()
+
+	added, err := redis.Bool(addScript.Do(
+		c,
+		hb.frontendKey(h),
+		string(h),
+		e.String(),
+		e.EffectiveWeight(),
+	))
+	if err != nil {
 		return err
 	}
-	log.Println("DEBUG [backend:hipache] Endpoint added", h, e.String())
+
+	if added {
+		log.Println("DEBUG [backend:hipache] Endpoint added", h, e.String())
+	} else {
+		log.Println("DEBUG [backend:hipache] Endpoint already present", h, e.String())
+	}
 
 	return nil
 }
+
 func (hb *HipacheBackend) RemoveEndpoint(
+	ctx context.Context,
 	h shared.Host,
 	e shared.Endpoint,
 ) error {
-	if _, err := hb.r.Do("LREM", prefixKey(h), 0, e.String()); err != nil {
+	// Routes with a path are never added
+	if h.Path() != "" {
+		return nil
+	}
+
+	c, err := hb.conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	if _, err := removeScript.Do(c, hb.frontendKey(h), e.String(), hb.deleteEmpty); err != nil {
 		return err
 	}
 
@@ -66,20 +181,58 @@ func (hb *HipacheBackend) RemoveEndpoint(
 	return nil
 }
 
-func (hb *HipacheBackend) Initialise() error {
-	return hb.clearHosts()
+// DrainEndpoint takes the endpoint out of the frontend so hipache stops
+// picking it, requests in flight aren't affected. The frontend is kept even
+// if it's left empty, since the route is removed later.
+func (hb *HipacheBackend) DrainEndpoint(
+	ctx context.Context,
+	h shared.Host,
+	e shared.Endpoint,
+) error {
+	if h.Path() != "" {
+		return nil
+	}
+
+	c, err := hb.conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	if _, err := removeScript.Do(c, hb.frontendKey(h), e.String(), "0"); err != nil {
+		return err
+	}
+
+	log.Println("DEBUG [backend:hipache] Endpoint drained", h, e.String())
+	return nil
 }
 
-func (hb *HipacheBackend) ListHosts() (*shared.HostList, error) {
+func (hb *HipacheBackend) Initialise(ctx context.Context) error {
+	c, err := hb.conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	return hb.clearHosts(c)
+}
+
+func (hb *HipacheBackend) ListHosts(ctx context.Context) (*shared.HostList, error) {
 	hl := shared.HostList{}
 
-	fe, err := hb.getFrontends()
+	c, err := hb.conn(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer c.Close()
+
+	fe, err := hb.getFrontends(c)
 	if err != nil {
 		return nil, err
 	}
 
 	for _, f := range fe {
-		r, err := redis.Values(hb.r.Do("LRANGE", f, "0", "-1"))
+		r, err := redis.Values(c.Do("LRANGE", f, "0", "-1"))
 		if err != nil {
 			return nil, err
 		}
@@ -101,11 +254,21 @@ func (hb *HipacheBackend) ListHosts() (*shared.HostList, error) {
 			continue
 		}
 
+		// Weighted endpoints are listed multiple times
+		seen := map[string]int{}
 		for _, b := range vs[1:] {
+			if i, ok := seen[b]; ok {
+				e := &hl[h][i]
+				e.Weight = e.EffectiveWeight() + 1
+				continue
+			}
+
 			e, err := shared.NewEndpointFromUrl(b)
 			if err != nil {
 				log.Printf("WARN Couldn't decode URL %s, %s", b, err)
+				continue
 			}
+			seen[b] = len(hl[h])
 			hl[h] = append(hl[h], *e)
 		}
 	}
@@ -113,59 +276,84 @@ func (hb *HipacheBackend) ListHosts() (*shared.HostList, error) {
 	return &hl, nil
 }
 
-func (hb *HipacheBackend) getFrontends() ([]string, error) {
-	r, err := redis.Values(hb.r.Do("KEYS", "frontend:*"))
-	if err != nil {
+// conn gets a connection from the pool, unless ctx is done. The vendored redigo
+// can't cancel commands in flight, those are bound by the IO timeout instead.
+func (hb *HipacheBackend) conn(ctx context.Context) (redis.Conn, error) {
+	if err := ctx.Err(); err != nil {
 		return nil, err
 	}
 
-	var fe []string
-	if err := redis.ScanSlice(r, &fe); err != nil {
+	c := hb.pool.Get()
+	if err := c.Err(); err != nil {
+		c.Close()
 		return nil, err
 	}
 
-	return fe, nil
+	return c, nil
 }
 
-func (hb *HipacheBackend) hostExists(h shared.Host) (bool, error) {
-	return redis.Bool(hb.r.Do("EXISTS", prefixKey(h)))
-}
+// getFrontends iterates over the frontend keys with SCAN, so redis isn't
+// blocked like it would be by KEYS.
+func (hb *HipacheBackend) getFrontends(c redis.Conn) ([]string, error) {
+	fe := []string{}
+	match := escapePattern(hb.prefix) + "frontend:*"
 
-func (hb *HipacheBackend) hostDelete(h shared.Host) error {
-	if _, err := hb.r.Do("DEL", prefixKey(h)); err != nil {
-		return err
-	}
-	log.Printf("DEBUG [backend:hipache] Host deleted '%s'\n", h)
+	cursor := "0"
+	for {
+		r, err := redis.Values(c.Do("SCAN", cursor, "MATCH", match, "COUNT", scanCount))
+		if err != nil {
+			return nil, err
+		}
 
-	return nil
+		var keys []string
+		if _, err := redis.Scan(r, &cursor, &keys); err != nil {
+			return nil, err
+		}
+		fe = append(fe, keys...)
+
+		if cursor == "0" {
+			return fe, nil
+		}
+	}
 }
 
-func (hb *HipacheBackend) hostCreate(h shared.Host) error {
-	if _, err := hb.r.Do("RPUSH", prefixKey(h), h); err != nil {
+func (hb *HipacheBackend) hostDelete(c redis.Conn, h shared.Host) error {
+	if _, err := c.Do("DEL", hb.frontendKey(h)); err != nil {
 		return err
 	}
-	log.Printf("DEBUG [backend:hipache] Host created: %s\n", h)
+	log.Printf("DEBUG [backend:hipache] Host deleted '%s'\n", h)
 
 	return nil
 }
 
-func (hb *HipacheBackend) clearHosts() error {
-	fe, err := hb.getFrontends()
+func (hb *HipacheBackend) clearHosts(c redis.Conn) error {
+	fe, err := hb.getFrontends(c)
 	if err != nil {
 		return err
 	}
 
-	for _, f := range fe {
-		if _, err := hb.r.Do("DEL", f); err != nil {
+	for len(fe) > 0 {
+		n := len(fe)
+		if n > scanCount {
+			n = scanCount
+		}
+
+		if _, err := c.Do("DEL", redis.Args{}.AddFlat(fe[:n])...); err != nil {
 			return err
 		}
+		fe = fe[n:]
 	}
 
 	return nil
 }
 
-func prefixKey(h shared.Host) string {
-	return "frontend:" + string(h)
+func (hb *HipacheBackend) frontendKey(h shared.Host) string {
+	return hb.prefix + "frontend:" + string(h)
+}
+
+// escapePattern escapes the glob characters SCAN's MATCH would interpret.
+func escapePattern(s string) string {
+	return patternEscaper.Replace(s)
 }
 
 func init() {
@@ -0,0 +1,142 @@
+package hipache
+
+import (
+	"context"
+	"fmt"
+	"github.com/3onyc/hipdate/shared"
+	"strings"
+	"testing"
+)
+
+func TestHipacheBackendScripts(t *testing.T) {
+	fr := newFakeRedis(t, redisRole("master"))
+	defer fr.Close()
+
+	be, err := NewHipacheBackend(shared.OptionMap{
+		"redis":        "redis://" + fr.Addr(),
+		"delete_empty": "true",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer be.(*HipacheBackend).Close()
+
+	h, e := shared.Host("example.com"), *shared.NewEndpoint("http", "10.0.0.1", 80)
+	if err := be.AddEndpoint(context.Background(), h, e); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := be.(*HipacheBackend).DrainEndpoint(context.Background(), h, e); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := be.RemoveEndpoint(context.Background(), h, e); err != nil {
+		t.Fatal(err)
+	}
+
+	evals := []string{}
+	for _, c := range fr.Commands() {
+		if strings.HasPrefix(c, "EVAL ") {
+			evals = append(evals, c)
+		}
+	}
+
+	if len(evals) != 3 ||
+		!strings.HasSuffix(evals[0], " 1 frontend:example.com example.com http://10.0.0.1:80 1") ||
+		!strings.HasSuffix(evals[1], " 1 frontend:example.com http://10.0.0.1:80 0") ||
+		!strings.HasSuffix(evals[2], " 1 frontend:example.com http://10.0.0.1:80 1") {
+		t.Logf("Unexpected scripts run %q", evals)
+		t.Fail()
+	}
+}
+
+func TestHipacheBackendScan(t *testing.T) {
+	pages := map[string][]string{
+		"0": {"5", "c[1]:frontend:a.example.com"},
+		"5": {"0", "c[1]:frontend:b.example.com"},
+	}
+
+	fr := newFakeRedis(t, func(args []string) string {
+		switch args[0] {
+		case "SCAN":
+			if args[3] != `c\[1\]:frontend:*` {
+				return "-ERR unexpected pattern " + args[3] + "\r\n"
+			}
+			p := pages[args[1]]
+			return "*2\r\n" + bulk(p[0]) + "*1\r\n" + bulk(p[1])
+		case "LRANGE":
+			h := strings.TrimPrefix(args[1], "c[1]:frontend:")
+			return "*2\r\n" + bulk(h) + bulk("http://10.0.0.1:80")
+		default:
+			return ":1\r\n"
+		}
+	})
+	defer fr.Close()
+
+	be, err := NewHipacheBackend(shared.OptionMap{
+		"redis":      "redis://" + fr.Addr(),
+		"key_prefix": "c[1]:",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer be.(*HipacheBackend).Close()
+
+	hl, err := be.ListHosts(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(*hl) != 2 || len((*hl)["a.example.com"]) != 1 || len((*hl)["b.example.com"]) != 1 {
+		t.Logf("Unexpected hosts %v", *hl)
+		t.Fail()
+	}
+
+	if err := be.Initialise(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	cs := fr.Commands()
+	if del := cs[len(cs)-1]; del != "DEL c[1]:frontend:a.example.com c[1]:frontend:b.example.com" {
+		t.Logf("Unexpected delete '%s'", del)
+		t.Fail()
+	}
+}
+
+func TestHipacheBackendWeights(t *testing.T) {
+	fr := newFakeRedis(t, func(args []string) string {
+		switch args[0] {
+		case "SCAN":
+			return "*2\r\n" + bulk("0") + "*1\r\n" + bulk("frontend:a.example.com")
+		case "LRANGE":
+			return "*4\r\n" + bulk("a.example.com") +
+				bulk("http://10.0.0.1:80") +
+				bulk("http://10.0.0.2:80") +
+				bulk("http://10.0.0.1:80")
+		default:
+			return ":1\r\n"
+		}
+	})
+	defer fr.Close()
+
+	be, err := NewHipacheBackend(shared.OptionMap{"redis": "redis://" + fr.Addr()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer be.(*HipacheBackend).Close()
+
+	hl, err := be.ListHosts(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	eps := (*hl)["a.example.com"]
+	if len(eps) != 2 || eps[0].Weight != 2 || eps[1].Weight != 0 {
+		t.Logf("Unexpected endpoints %+v", eps)
+		t.Fail()
+	}
+}
+
+func bulk(s string) string {
+	return fmt.Sprintf("$%d\r\n%s\r\n", len(s), s)
+}
@@ -1,38 +1,155 @@
 package hipache
 
 import (
+	"crypto/tls"
 	"errors"
 	"github.com/garyburd/redigo/redis"
+	"net"
 	"net/url"
+	"strconv"
+	"strings"
+	"time"
 )
 
 var (
-	WrongSchemeError = errors.New("scheme is not redis://")
+	WrongSchemeError     = errors.New("scheme is not redis:// or rediss://")
+	InvalidDatabaseError = errors.New("redis database is not a number")
 )
 
-func parseRedisUrl(urlStr string) (string, error) {
+const (
+	defaultRedisPort = "6379"
+
+	redisConnectTimeout = 5 * time.Second
+	redisIOTimeout      = 10 * time.Second
+	redisIdleTimeout    = 4 * time.Minute
+	redisMaxIdle        = 3
+	redisCheckInterval  = time.Minute
+)
+
+// redisConfig is what's needed to connect to redis, parsed from an URL like
+// redis://:password@host:port/db, using rediss:// enables TLS.
+type redisConfig struct {
+	Addr     string
+	Password string
+	DB       int
+	TLS      *tls.Config
+	Sentinel *sentinel
+}
+
+func parseRedisUrl(urlStr string) (*redisConfig, error) {
 	redisUrl, err := url.Parse(urlStr)
 	if err != nil {
-		return "", err
+		return nil, err
+	}
+
+	port := redisUrl.Port()
+	if port == "" {
+		port = defaultRedisPort
+	}
+
+	rc := &redisConfig{Addr: net.JoinHostPort(redisUrl.Hostname(), port)}
+	switch redisUrl.Scheme {
+	case "redis":
+	case "rediss":
+		rc.TLS = &tls.Config{ServerName: redisUrl.Hostname()}
+	default:
+		return nil, WrongSchemeError
 	}
 
-	if redisUrl.Scheme != "redis" {
-		return "", WrongSchemeError
+	if redisUrl.User != nil {
+		rc.Password, _ = redisUrl.User.Password()
 	}
 
-	return redisUrl.Host, nil
+	if db := strings.Trim(redisUrl.Path, "/"); db != "" {
+		n, err := strconv.Atoi(db)
+		if err != nil || n < 0 {
+			return nil, InvalidDatabaseError
+		}
+		rc.DB = n
+	}
+
+	return rc, nil
 }
 
-func createRedisConn(ru string) (*redis.Conn, error) {
-	re, err := parseRedisUrl(ru)
-	if err != nil {
-		return nil, err
+// dialRedis opens a connection, and authenticates and selects the database
+// if configured.
+func dialRedis(rc *redisConfig) (redis.Conn, error) {
+	addr, tc := rc.Addr, rc.TLS
+	if rc.Sentinel != nil {
+		a, err := rc.Sentinel.masterAddr()
+		if err != nil {
+			return nil, err
+		}
+
+		addr = a
+		if tc != nil {
+			tc = tc.Clone()
+			tc.ServerName, _, _ = net.SplitHostPort(addr)
+		}
 	}
 
-	r, err := redis.Dial("tcp", re)
+	nc, err := net.DialTimeout("tcp", addr, redisConnectTimeout)
 	if err != nil {
 		return nil, err
 	}
 
-	return &r, nil
+	if tc != nil {
+		tlc := tls.Client(nc, tc)
+		tlc.SetDeadline(time.Now().Add(redisConnectTimeout))
+		if err := tlc.Handshake(); err != nil {
+			nc.Close()
+			return nil, err
+		}
+		tlc.SetDeadline(time.Time{})
+		nc = tlc
+	}
+
+	c := redis.NewConn(nc, redisIOTimeout, redisIOTimeout)
+	if rc.Password != "" {
+		if _, err := c.Do("AUTH", rc.Password); err != nil {
+			c.Close()
+			return nil, err
+		}
+	}
+
+	if rc.DB != 0 {
+		if _, err := c.Do("SELECT", rc.DB); err != nil {
+			c.Close()
+			return nil, err
+		}
+	}
+
+	if rc.Sentinel != nil {
+		if err := checkMaster(c); err != nil {
+			c.Close()
+			return nil, err
+		}
+	}
+
+	return c, nil
+}
+
+// newRedisPool returns a pool that reconnects as needed, idle connections are
+// checked before they're reused. With sentinel every connection is checked to
+// still be connected to the master, so failovers are followed.
+func newRedisPool(rc *redisConfig) *redis.Pool {
+	return &redis.Pool{
+		Dial: func() (redis.Conn, error) {
+			return dialRedis(rc)
+		},
+		TestOnBorrow: func(c redis.Conn, t time.Time) error {
+			if rc.Sentinel != nil {
+				return checkMaster(c)
+			}
+
+			if time.Since(t) < redisCheckInterval {
+				return nil
+			}
+
+			_, err := c.Do("PING")
+			return err
+		},
+		MaxIdle:     redisMaxIdle,
+		IdleTimeout: redisIdleTimeout,
+	}
 }
@@ -0,0 +1,174 @@
+package hipache
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestParseRedisUrl(t *testing.T) {
+	rc, err := parseRedisUrl("redis://:secret@redis.local:6380/2")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if rc.Addr != "redis.local:6380" || rc.Password != "secret" || rc.DB != 2 || rc.TLS != nil {
+		t.Logf("Unexpected config %+v", rc)
+		t.Fail()
+	}
+}
+
+func TestParseRedisUrlDefaults(t *testing.T) {
+	rc, err := parseRedisUrl("rediss://redis.local")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if rc.Addr != "redis.local:6379" || rc.Password != "" || rc.DB != 0 {
+		t.Logf("Unexpected config %+v", rc)
+		t.Fail()
+	}
+
+	if rc.TLS == nil || rc.TLS.ServerName != "redis.local" {
+		t.Log("TLS not enabled for rediss://")
+		t.Fail()
+	}
+}
+
+func TestParseRedisUrlErrors(t *testing.T) {
+	if _, err := parseRedisUrl("http://redis.local"); err != WrongSchemeError {
+		t.Logf("Expected WrongSchemeError, got %v", err)
+		t.Fail()
+	}
+
+	if _, err := parseRedisUrl("redis://redis.local/db"); err != InvalidDatabaseError {
+		t.Logf("Expected InvalidDatabaseError, got %v", err)
+		t.Fail()
+	}
+}
+
+// fakeRedis speaks just enough RESP to stand in for a redis or sentinel,
+// replies come from the handler as raw RESP.
+type fakeRedis struct {
+	l        net.Listener
+	mu       sync.Mutex
+	handler  func(args []string) string
+	commands []string
+}
+
+func newFakeRedis(t *testing.T, handler func(args []string) string) *fakeRedis {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fr := &fakeRedis{l: l, handler: handler}
+	go fr.serve()
+
+	return fr
+}
+
+func (fr *fakeRedis) serve() {
+	for {
+		c, err := fr.l.Accept()
+		if err != nil {
+			return
+		}
+
+		go fr.handle(c)
+	}
+}
+
+func (fr *fakeRedis) handle(c net.Conn) {
+	defer c.Close()
+
+	r := bufio.NewReader(c)
+	for {
+		args, err := readCommand(r)
+		if err != nil {
+			return
+		}
+
+		fr.mu.Lock()
+		fr.commands = append(fr.commands, strings.Join(args, " "))
+		h := fr.handler
+		fr.mu.Unlock()
+
+		if _, err := fmt.Fprint(c, h(args)); err != nil {
+			return
+		}
+	}
+}
+
+func (fr *fakeRedis) setHandler(h func(args []string) string) {
+	fr.mu.Lock()
+	defer fr.mu.Unlock()
+
+	fr.handler = h
+}
+
+func (fr *fakeRedis) received(cmd string) bool {
+	fr.mu.Lock()
+	defer fr.mu.Unlock()
+
+	for _, c := range fr.commands {
+		if strings.HasPrefix(c, cmd) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (fr *fakeRedis) Commands() []string {
+	fr.mu.Lock()
+	defer fr.mu.Unlock()
+
+	return append([]string{}, fr.commands...)
+}
+
+func (fr *fakeRedis) Addr() string {
+	return fr.l.Addr().String()
+}
+
+func (fr *fakeRedis) Close() {
+	fr.l.Close()
+}
+
+func readCommand(r *bufio.Reader) ([]string, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+
+	n, err := strconv.Atoi(strings.TrimSpace(line[1:]))
+	if err != nil {
+		return nil, err
+	}
+
+	args := make([]string, n)
+	for i := range args {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+
+		l, err := strconv.Atoi(strings.TrimSpace(line[1:]))
+		if err != nil {
+			return nil, err
+		}
+
+		b := make([]byte, l+2)
+		if _, err := io.ReadFull(r, b); err != nil {
+			return nil, err
+		}
+		args[i] = string(b[:l])
+	}
+
+	return args, nil
+}
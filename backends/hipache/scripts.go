@@ -0,0 +1,48 @@
+package hipache
+
+import (
+	"github.com/garyburd/redigo/redis"
+)
+
+// The frontend lists hipache reads start with an identifier, followed by the
+// backend URLs. The scripts below update them atomically.
+
+// addScript creates the frontend if needed and appends the endpoint ARGV[3]
+// times, hipache picks a random entry so that weights it. Returns 1 if the
+// endpoint was added or its weight changed.
+var addScript = redis.NewScript(1, `
+if redis.call("EXISTS", KEYS[1]) == 0 then
+	redis.call("RPUSH", KEYS[1], ARGV[1])
+end
+
+local weight = tonumber(ARGV[3])
+local n = 0
+for _, b in ipairs(redis.call("LRANGE", KEYS[1], 1, -1)) do
+	if b == ARGV[2] then
+		n = n + 1
+	end
+end
+
+if n == weight then
+	return 0
+end
+
+redis.call("LREM", KEYS[1], 0, ARGV[2])
+for i = 1, weight do
+	redis.call("RPUSH", KEYS[1], ARGV[2])
+end
+return 1
+`)
+
+// removeScript removes the endpoint from the frontend, and deletes the
+// frontend when it has no endpoints left and ARGV[2] is "1". Returns the
+// number of entries removed.
+var removeScript = redis.NewScript(1, `
+local n = redis.call("LREM", KEYS[1], 0, ARGV[1])
+
+if ARGV[2] == "1" and redis.call("LLEN", KEYS[1]) <= 1 then
+	redis.call("DEL", KEYS[1])
+end
+
+return n
+`)
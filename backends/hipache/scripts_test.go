@@ -0,0 +1,189 @@
+package hipache
+
+import (
+	"context"
+	"fmt"
+	"github.com/3onyc/hipdate/shared"
+	"github.com/garyburd/redigo/redis"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// The tests below run the scripts on the redis server in HIPACHE_TEST_REDIS
+// (host:port), they're skipped if it isn't set. Their keys get a unique
+// prefix and are deleted afterwards.
+
+func newRedisBackend(t *testing.T, deleteEmpty bool) (*HipacheBackend, redis.Conn) {
+	addr := os.Getenv("HIPACHE_TEST_REDIS")
+	if addr == "" {
+		t.Skip("HIPACHE_TEST_REDIS not set")
+	}
+
+	c, err := redis.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	opts := shared.OptionMap{
+		"redis":      "redis://" + addr,
+		"key_prefix": fmt.Sprintf("hipdate-test:%d:", time.Now().UnixNano()),
+	}
+	if deleteEmpty {
+		opts["delete_empty"] = "true"
+	}
+
+	be, err := NewHipacheBackend(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return be.(*HipacheBackend), c
+}
+
+func cleanup(hb *HipacheBackend, c redis.Conn) {
+	keys, _ := redis.Strings(c.Do("KEYS", patternEscaper.Replace(hb.prefix)+"*"))
+	for _, k := range keys {
+		c.Do("DEL", k)
+	}
+
+	c.Close()
+	hb.Close()
+}
+
+func frontend(t *testing.T, hb *HipacheBackend, c redis.Conn, h shared.Host) string {
+	exists, err := redis.Bool(c.Do("EXISTS", hb.frontendKey(h)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !exists {
+		return "<none>"
+	}
+
+	l, err := redis.Strings(c.Do("LRANGE", hb.frontendKey(h), 0, -1))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return strings.Join(l, " ")
+}
+
+func TestScriptsIdempotent(t *testing.T) {
+	hb, c := newRedisBackend(t, true)
+	defer cleanup(hb, c)
+
+	ctx, h := context.Background(), shared.Host("example.com")
+	e1 := *shared.NewEndpoint("http", "10.0.0.1", 80)
+	e2 := *shared.NewEndpoint("http", "10.0.0.2", 80)
+
+	steps := []struct {
+		op       func() error
+		expected string
+	}{
+		{func() error { return hb.AddEndpoint(ctx, h, e1) }, "example.com http://10.0.0.1:80"},
+		{func() error { return hb.AddEndpoint(ctx, h, e1) }, "example.com http://10.0.0.1:80"},
+		{func() error { return hb.AddEndpoint(ctx, h, e2) }, "example.com http://10.0.0.1:80 http://10.0.0.2:80"},
+		{func() error { return hb.RemoveEndpoint(ctx, h, e1) }, "example.com http://10.0.0.2:80"},
+		{func() error { return hb.RemoveEndpoint(ctx, h, e1) }, "example.com http://10.0.0.2:80"},
+		{func() error { return hb.RemoveEndpoint(ctx, h, e2) }, "<none>"},
+	}
+
+	for i, s := range steps {
+		if err := s.op(); err != nil {
+			t.Fatal(err)
+		}
+
+		if l := frontend(t, hb, c, h); l != s.expected {
+			t.Logf("Expected '%s' after step %d, got '%s'", s.expected, i+1, l)
+			t.Fail()
+		}
+	}
+}
+
+func TestScriptsWeight(t *testing.T) {
+	hb, c := newRedisBackend(t, false)
+	defer cleanup(hb, c)
+
+	ctx, h := context.Background(), shared.Host("example.com")
+	e := *shared.NewEndpoint("http", "10.0.0.1", 80)
+
+	e.Weight = 3
+	if err := hb.AddEndpoint(ctx, h, e); err != nil {
+		t.Fatal(err)
+	}
+
+	if l := frontend(t, hb, c, h); strings.Count(l, e.String()) != 3 {
+		t.Logf("Expected the endpoint 3 times, got '%s'", l)
+		t.Fail()
+	}
+
+	e.Weight = 1
+	if err := hb.AddEndpoint(ctx, h, e); err != nil {
+		t.Fatal(err)
+	}
+
+	if l := frontend(t, hb, c, h); l != "example.com http://10.0.0.1:80" {
+		t.Logf("Expected the endpoint once, got '%s'", l)
+		t.Fail()
+	}
+
+	// Frontends are kept unless delete_empty is set, drains always keep them
+	if err := hb.DrainEndpoint(ctx, h, e); err != nil {
+		t.Fatal(err)
+	}
+
+	if l := frontend(t, hb, c, h); l != "example.com" {
+		t.Logf("Expected the drained frontend to be empty, got '%s'", l)
+		t.Fail()
+	}
+
+	if err := hb.RemoveEndpoint(ctx, h, e); err != nil {
+		t.Fatal(err)
+	}
+
+	if l := frontend(t, hb, c, h); l != "example.com" {
+		t.Logf("Expected the empty frontend to be kept, got '%s'", l)
+		t.Fail()
+	}
+}
+
+// Concurrent updates of a new frontend must neither create it twice nor
+// lose endpoints.
+func TestScriptsAtomic(t *testing.T) {
+	hb, c := newRedisBackend(t, false)
+	defer cleanup(hb, c)
+
+	ctx, h := context.Background(), shared.Host("example.com")
+	wg := sync.WaitGroup{}
+	for i := 0; i < 20; i++ {
+		wg.Add(2)
+		e := *shared.NewEndpoint("http", fmt.Sprintf("10.0.0.%d", i%10), 80)
+		for j := 0; j < 2; j++ {
+			go func() {
+				defer wg.Done()
+				if err := hb.AddEndpoint(ctx, h, e); err != nil {
+					t.Error(err)
+				}
+			}()
+		}
+	}
+	wg.Wait()
+
+	l := strings.Fields(frontend(t, hb, c, h))
+	seen := map[string]bool{}
+	for _, b := range l[1:] {
+		if seen[b] {
+			t.Logf("Duplicate endpoint %s", b)
+			t.Fail()
+		}
+		seen[b] = true
+	}
+
+	if l[0] != "example.com" || len(seen) != 10 {
+		t.Logf("Unexpected frontend %v", l)
+		t.Fail()
+	}
+}
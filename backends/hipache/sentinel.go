@@ -0,0 +1,96 @@
+package hipache
+
+import (
+	"errors"
+	"github.com/garyburd/redigo/redis"
+	"log"
+	"net"
+	"strings"
+)
+
+var (
+	MissingSentinelMasterError = errors.New("sentinel_master not specified")
+	NoSentinelsError           = errors.New("no sentinels specified")
+	NotMasterError             = errors.New("redis is not a master")
+	SentinelUnavailableError   = errors.New("no sentinel could be reached")
+)
+
+// sentinel looks up the current master through Redis Sentinel.
+type sentinel struct {
+	master string
+	addrs  []string
+}
+
+func newSentinel(master, addrs string) (*sentinel, error) {
+	if master == "" {
+		return nil, MissingSentinelMasterError
+	}
+
+	s := &sentinel{master: master}
+	for _, a := range strings.Split(addrs, ",") {
+		if a = strings.TrimSpace(a); a != "" {
+			s.addrs = append(s.addrs, a)
+		}
+	}
+
+	if len(s.addrs) == 0 {
+		return nil, NoSentinelsError
+	}
+
+	return s, nil
+}
+
+// masterAddr asks the sentinels in turn for the address of the master,
+// returning the first answer.
+func (s *sentinel) masterAddr() (string, error) {
+	err := SentinelUnavailableError
+	for _, a := range s.addrs {
+		var addr string
+		addr, err = s.queryMaster(a)
+		if err == nil {
+			return addr, nil
+		}
+
+		log.Printf("WARN [backend:hipache] Sentinel %s: %s", a, err)
+	}
+
+	return "", err
+}
+
+func (s *sentinel) queryMaster(a string) (string, error) {
+	c, err := redis.DialTimeout("tcp", a, redisConnectTimeout, redisIOTimeout, redisIOTimeout)
+	if err != nil {
+		return "", err
+	}
+	defer c.Close()
+
+	r, err := redis.Strings(c.Do("SENTINEL", "get-master-addr-by-name", s.master))
+	if err != nil {
+		return "", err
+	}
+
+	if len(r) != 2 {
+		return "", errors.New("unknown master " + s.master)
+	}
+
+	return net.JoinHostPort(r[0], r[1]), nil
+}
+
+// checkMaster makes sure c is connected to a master, after a failover the old
+// master comes back as a replica.
+func checkMaster(c redis.Conn) error {
+	r, err := redis.Values(c.Do("ROLE"))
+	if err != nil {
+		return err
+	}
+
+	if len(r) == 0 {
+		return NotMasterError
+	}
+
+	if role, err := redis.String(r[0], nil); err != nil || role != "master" {
+		return NotMasterError
+	}
+
+	return nil
+}
@@ -0,0 +1,106 @@
+package hipache
+
+import (
+	"context"
+	"fmt"
+	"github.com/3onyc/hipdate/shared"
+	"net"
+	"strings"
+	"testing"
+)
+
+// redisRole returns a handler for a redis with the given role, that accepts
+// any other command.
+func redisRole(role string) func(args []string) string {
+	return func(args []string) string {
+		switch strings.ToUpper(args[0]) {
+		case "ROLE":
+			return fmt.Sprintf("*1\r\n$%d\r\n%s\r\n", len(role), role)
+		case "EVALSHA":
+			return "-NOSCRIPT No matching script\r\n"
+		case "EVAL":
+			return ":1\r\n"
+		default:
+			return "+OK\r\n"
+		}
+	}
+}
+
+func sentinelFor(addr string) func(args []string) string {
+	h, p, _ := net.SplitHostPort(addr)
+	return func(args []string) string {
+		if len(args) == 3 && args[2] == "mymaster" {
+			return fmt.Sprintf("*2\r\n$%d\r\n%s\r\n$%d\r\n%s\r\n", len(h), h, len(p), p)
+		}
+
+		return "*-1\r\n"
+	}
+}
+
+func TestSentinelFailover(t *testing.T) {
+	a := newFakeRedis(t, redisRole("master"))
+	defer a.Close()
+	b := newFakeRedis(t, redisRole("slave"))
+	defer b.Close()
+	s := newFakeRedis(t, sentinelFor(a.Addr()))
+	defer s.Close()
+
+	be, err := NewHipacheBackend(shared.OptionMap{
+		"sentinels":       "127.0.0.1:1," + s.Addr(),
+		"sentinel_master": "mymaster",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer be.(*HipacheBackend).Close()
+
+	h, e := shared.Host("example.com"), *shared.NewEndpoint("http", "10.0.0.1", 80)
+	if err := be.AddEndpoint(context.Background(), h, e); err != nil {
+		t.Fatal(err)
+	}
+
+	if !a.received("EVAL ") {
+		t.Log("Endpoint not added to the initial master")
+		t.Fail()
+	}
+
+	a.setHandler(redisRole("slave"))
+	b.setHandler(redisRole("master"))
+	s.setHandler(sentinelFor(b.Addr()))
+
+	if err := be.AddEndpoint(context.Background(), h, e); err != nil {
+		t.Fatal(err)
+	}
+
+	if !b.received("EVAL ") {
+		t.Log("Endpoint not added to the new master after failover")
+		t.Fail()
+	}
+}
+
+func TestSentinelUnknownMaster(t *testing.T) {
+	s := newFakeRedis(t, sentinelFor("127.0.0.1:1"))
+	defer s.Close()
+
+	sn, err := newSentinel("other", s.Addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := sn.masterAddr(); err == nil {
+		t.Log("Expected an error for an unknown master")
+		t.Fail()
+	}
+}
+
+func TestNewSentinelErrors(t *testing.T) {
+	if _, err := newSentinel("", "127.0.0.1:26379"); err != MissingSentinelMasterError {
+		t.Logf("Expected MissingSentinelMasterError, got %v", err)
+		t.Fail()
+	}
+
+	if _, err := newSentinel("mymaster", " , "); err != NoSentinelsError {
+		t.Logf("Expected NoSentinelsError, got %v", err)
+		t.Fail()
+	}
+}
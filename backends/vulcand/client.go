@@ -0,0 +1,179 @@
+package vulcand
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	vbackend "github.com/mailgun/vulcand/backend"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+const (
+	apiTimeout = 10 * time.Second
+)
+
+// The v2 API models routing as frontends matching requests with a route
+// expression, passing them to a backend made up of servers.
+
+type frontend struct {
+	Id        string
+	Type      string
+	BackendId string
+	Route     string
+}
+
+type backend struct {
+	Id   string
+	Type string
+}
+
+type server struct {
+	Id  string
+	URL string
+}
+
+type frontendMiddleware struct {
+	Id         string
+	Priority   int
+	Type       string
+	Middleware json.RawMessage
+}
+
+type apiError struct {
+	Status  int
+	Message string
+}
+
+func (e *apiError) Error() string {
+	return fmt.Sprintf("vulcand api: %d %s", e.Status, e.Message)
+}
+
+// isNotFound reports whether err is a not found error from either API.
+func isNotFound(err error) bool {
+	switch e := err.(type) {
+	case *apiError:
+		return e.Status == http.StatusNotFound
+	case *vbackend.NotFoundError:
+		return true
+	}
+
+	return false
+}
+
+// client is a minimal client for the parts of the vulcand v2 API hipdated
+// needs.
+type client struct {
+	url string
+	c   *http.Client
+}
+
+func newClient(u string) *client {
+	return &client{url: u, c: &http.Client{Timeout: apiTimeout}}
+}
+
+func (c *client) do(ctx context.Context, method, path string, in, out interface{}) error {
+	var body bytes.Buffer
+	if in != nil {
+		if err := json.NewEncoder(&body).Encode(in); err != nil {
+			return err
+		}
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, c.url+path, &body)
+	if err != nil {
+		return err
+	}
+
+	if in != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := c.c.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		var m struct{ Message string }
+		json.NewDecoder(resp.Body).Decode(&m)
+		return &apiError{resp.StatusCode, m.Message}
+	}
+
+	if out == nil {
+		return nil
+	}
+
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+func (c *client) status(ctx context.Context) error {
+	return c.do(ctx, "GET", "/v2/status", nil, nil)
+}
+
+func (c *client) frontends(ctx context.Context) ([]frontend, error) {
+	var r struct{ Frontends []frontend }
+	err := c.do(ctx, "GET", "/v2/frontends", nil, &r)
+	return r.Frontends, err
+}
+
+func (c *client) upsertFrontend(ctx context.Context, f frontend) error {
+	return c.do(ctx, "POST", "/v2/frontends", map[string]interface{}{"Frontend": f}, nil)
+}
+
+func (c *client) deleteFrontend(ctx context.Context, id string) error {
+	return c.do(ctx, "DELETE", "/v2/frontends/"+url.PathEscape(id), nil, nil)
+}
+
+func (c *client) backends(ctx context.Context) ([]backend, error) {
+	var r struct{ Backends []backend }
+	err := c.do(ctx, "GET", "/v2/backends", nil, &r)
+	return r.Backends, err
+}
+
+func (c *client) upsertBackend(ctx context.Context, b backend) error {
+	return c.do(ctx, "POST", "/v2/backends", map[string]interface{}{"Backend": b}, nil)
+}
+
+func (c *client) deleteBackend(ctx context.Context, id string) error {
+	return c.do(ctx, "DELETE", "/v2/backends/"+url.PathEscape(id), nil, nil)
+}
+
+func (c *client) servers(ctx context.Context, backendId string) ([]server, error) {
+	var r struct{ Servers []server }
+	err := c.do(ctx, "GET", "/v2/backends/"+url.PathEscape(backendId)+"/servers", nil, &r)
+	return r.Servers, err
+}
+
+func (c *client) upsertServer(ctx context.Context, backendId string, s server) error {
+	return c.do(
+		ctx,
+		"POST",
+		"/v2/backends/"+url.PathEscape(backendId)+"/servers",
+		map[string]interface{}{"Server": s},
+		nil,
+	)
+}
+
+func (c *client) deleteServer(ctx context.Context, backendId, id string) error {
+	return c.do(
+		ctx,
+		"DELETE",
+		"/v2/backends/"+url.PathEscape(backendId)+"/servers/"+url.PathEscape(id),
+		nil,
+		nil,
+	)
+}
+
+func (c *client) upsertMiddleware(ctx context.Context, frontendId string, m frontendMiddleware) error {
+	return c.do(
+		ctx,
+		"POST",
+		"/v2/frontends/"+url.PathEscape(frontendId)+"/middlewares",
+		map[string]interface{}{"Middleware": m},
+		nil,
+	)
+}
@@ -1,6 +1,7 @@
 package vulcand
 
 import (
+	"context"
 	"errors"
 	"github.com/3onyc/hipdate/backends"
 	"github.com/3onyc/hipdate/shared"
@@ -8,15 +9,31 @@ import (
 	"github.com/mailgun/vulcand/plugin/registry"
 	"log"
 	"net/http"
+	"regexp"
 	"strings"
 )
 
 var (
 	MissingApiUrlError = errors.New("vulcand api endpoint not specified")
+	UnknownModeError   = errors.New("vulcand mode must be v1 or v2")
+
+	regexpUnquoter = regexp.MustCompile(`\\(.)`)
 )
 
+// VulcandBackend writes the routes as hosts, locations and upstreams, using
+// vulcand's legacy v1 API. It's configured through the following options:
+//
+//	url           vulcand API endpoint
+//	mode          v1 (default), or v2 to use VulcandV2Backend
+//	delete_empty  "true" to delete a host once its last endpoint is removed
+//
+// Middlewares are attached to hosts with middleware:<host>:<id> options, see
+// middleware for their format. The v1 client can't cancel requests in flight,
+// operations only check their context before starting.
 type VulcandBackend struct {
-	v *vulcan.Client
+	v           *vulcan.Client
+	deleteEmpty bool
+	middlewares middlewareMap
 }
 
 func NewVulcandBackend(opts shared.OptionMap) (backends.Backend, error) {
@@ -25,27 +42,47 @@ func NewVulcandBackend(opts shared.OptionMap) (backends.Backend, error) {
 		return nil, MissingApiUrlError
 	}
 
+	switch opts["mode"] {
+	case "", "v1":
+	case "v2":
+		return NewVulcandV2Backend(eu, opts)
+	default:
+		return nil, UnknownModeError
+	}
+
+	mm, err := parseMiddlewares(opts)
+	if err != nil {
+		return nil, err
+	}
+
 	v, err := createClient(eu)
 	if err != nil {
 		return nil, err
 	}
 
 	return &VulcandBackend{
-		v: v,
+		v:           v,
+		deleteEmpty: opts["delete_empty"] == "true",
+		middlewares: mm,
 	}, nil
 }
 
 func (vb *VulcandBackend) AddEndpoint(
+	ctx context.Context,
 	h shared.Host,
 	e shared.Endpoint,
 ) error {
-	hName := string(h)
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	hName, rId := h.Name(), routeId(h)
 	eUrl := e.String()
-	uId := hName + "_up"
-	eId := hName + "_ep_" + e.Hash()
-	lId := hName + "_loc"
+	uId := rId + "_up"
+	eId := rId + "_ep_" + e.Hash()
+	lId := rId + "_loc"
 
-	if _, err := vb.v.AddHost(string(h)); isError(err) {
+	if _, err := vb.v.AddHost(hName); isError(err) {
 		return err
 	}
 
@@ -57,27 +94,130 @@ func (vb *VulcandBackend) AddEndpoint(
 		return err
 	}
 
-	if _, err := vb.v.AddLocation(hName, lId, "/.*", uId); isError(err) {
+	if _, err := vb.v.AddLocation(hName, lId, pathRegexp(h), uId); isError(err) {
 		return err
 	}
 
+	// Attached on every add, an earlier add may have failed to attach them
+	for _, m := range vb.middlewares.forHost(h) {
+		if err := vb.upsertMiddleware(hName, lId, m); err != nil {
+			return err
+		}
+	}
+
 	return nil
 }
+
+// upsertMiddleware attaches a middleware to a location, or updates it if
+// it's already attached.
+func (vb *VulcandBackend) upsertMiddleware(hName, lId string, m *middleware) error {
+	_, err := vb.v.AddMiddleware(m.Spec, hName, lId, m.Instance)
+	if isError(err) || err == nil {
+		return err
+	}
+
+	_, err = vb.v.UpdateMiddleware(m.Spec, hName, lId, m.Instance)
+	return err
+}
+
 func (vb *VulcandBackend) RemoveEndpoint(
+	ctx context.Context,
 	h shared.Host,
 	e shared.Endpoint,
 ) error {
-	uId := string(h) + "_up"
-	eId := string(h) + "_ep_" + e.Hash()
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	uId := routeId(h) + "_up"
+	eId := routeId(h) + "_ep_" + e.Hash()
+
+	// Drained endpoints are already gone
+	if _, err := vb.v.DeleteEndpoint(uId, eId); err != nil && !isNotFound(err) {
+		return err
+	}
+
+	if vb.deleteEmpty {
+		return vb.deleteIfEmpty(h)
+	}
+
+	return nil
+}
+
+// DrainEndpoint deletes the endpoint from the upstream so vulcand stops
+// sending it new requests, the ones in flight are left to finish. The host
+// and location are kept even if they're left empty, the route is removed
+// later.
+func (vb *VulcandBackend) DrainEndpoint(
+	ctx context.Context,
+	h shared.Host,
+	e shared.Endpoint,
+) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	uId := routeId(h) + "_up"
+	eId := routeId(h) + "_ep_" + e.Hash()
+
+	if _, err := vb.v.DeleteEndpoint(uId, eId); err != nil && !isNotFound(err) {
+		return err
+	}
+
+	log.Println("DEBUG [backend:vulcand] Endpoint drained", h, e.String())
+	return nil
+}
+
+// deleteIfEmpty tears down the location and upstream of a route without
+// endpoints, and the host once it has no locations left, so vulcand stops
+// routing it.
+func (vb *VulcandBackend) deleteIfEmpty(h shared.Host) error {
+	hName := h.Name()
+	uId := routeId(h) + "_up"
+	lId := routeId(h) + "_loc"
+
+	u, err := vb.v.GetUpstream(uId)
+	if isNotFound(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	if len(u.Endpoints) > 0 {
+		return nil
+	}
 
-	if _, err := vb.v.DeleteEndpoint(uId, eId); isError(err) {
+	if _, err := vb.v.DeleteLocation(hName, lId); err != nil && !isNotFound(err) {
 		return err
 	}
 
+	if _, err := vb.v.DeleteUpstream(uId); err != nil && !isNotFound(err) {
+		return err
+	}
+
+	vh, err := vb.v.GetHost(hName)
+	if err != nil && !isNotFound(err) {
+		return err
+	}
+
+	if err == nil && len(vh.Locations) > 0 {
+		log.Println("DEBUG [backend:vulcand] Empty route deleted", h)
+		return nil
+	}
+
+	if _, err := vb.v.DeleteHost(hName); err != nil && !isNotFound(err) {
+		return err
+	}
+
+	log.Println("DEBUG [backend:vulcand] Empty host deleted", h)
 	return nil
 }
 
-func (vb *VulcandBackend) Initialise() error {
+func (vb *VulcandBackend) Initialise(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
 	hosts, err := vb.v.GetHosts()
 	if err != nil {
 		return err
@@ -103,7 +243,11 @@ func (vb *VulcandBackend) Initialise() error {
 	return nil
 }
 
-func (vb *VulcandBackend) ListHosts() (*shared.HostList, error) {
+func (vb *VulcandBackend) ListHosts(ctx context.Context) (*shared.HostList, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
 	hl := shared.HostList{}
 
 	hs, err := vb.v.GetHosts()
@@ -112,20 +256,21 @@ func (vb *VulcandBackend) ListHosts() (*shared.HostList, error) {
 	}
 
 	for _, vh := range hs {
-		if len(vh.Locations) == 0 {
-			continue
-		}
-
-		l := vh.Locations[0]
-		h := shared.Host(l.Hostname)
+		for _, l := range vh.Locations {
+			h := shared.NewHost(l.Hostname, regexpPath(l.Path))
+			if _, ok := hl[h]; !ok {
+				hl[h] = []shared.Endpoint{}
+			}
 
-		hl[h] = []shared.Endpoint{}
+			if l.Upstream == nil {
+				continue
+			}
 
-		if l.Upstream != nil && len(l.Upstream.Endpoints) > 0 {
 			for _, ep := range l.Upstream.Endpoints {
 				e, err := shared.NewEndpointFromUrl(ep.Url)
 				if err != nil {
 					log.Printf("WARN Couldn't decode URL %s, %s", ep.Url, err)
+					continue
 				}
 				hl[h] = append(hl[h], *e)
 			}
@@ -135,6 +280,26 @@ func (vb *VulcandBackend) ListHosts() (*shared.HostList, error) {
 	return &hl, nil
 }
 
+// routeId returns the id the objects of a route are named after, the host
+// name for routes without a path.
+func routeId(h shared.Host) string {
+	return strings.Replace(string(h), "/", "_", -1)
+}
+
+// pathRegexp returns the regexp matching the paths of a route.
+func pathRegexp(h shared.Host) string {
+	if h.Path() == "" {
+		return "/.*"
+	}
+
+	return regexp.QuoteMeta(h.Path()) + ".*"
+}
+
+// regexpPath is the reverse of pathRegexp.
+func regexpPath(re string) string {
+	return regexpUnquoter.ReplaceAllString(strings.TrimSuffix(re, ".*"), "$1")
+}
+
 func isError(err error) bool {
 	if err == nil {
 		return false
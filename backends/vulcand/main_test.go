@@ -0,0 +1,361 @@
+package vulcand
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/3onyc/hipdate/backends"
+	"github.com/3onyc/hipdate/shared"
+	vbackend "github.com/mailgun/vulcand/backend"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakeV1Api keeps hosts, locations and upstreams in memory, like vulcand's
+// v1 API.
+type fakeV1Api struct {
+	*httptest.Server
+	mu          sync.Mutex
+	hosts       map[string]map[string]*vbackend.Location
+	upstreams   map[string]*vbackend.Upstream
+	middlewares map[string][]string
+	updates     int
+	failing     bool
+}
+
+func newFakeV1Api() *fakeV1Api {
+	fa := &fakeV1Api{
+		hosts:       map[string]map[string]*vbackend.Location{},
+		upstreams:   map[string]*vbackend.Upstream{},
+		middlewares: map[string][]string{},
+	}
+	fa.Server = httptest.NewServer(http.HandlerFunc(fa.handle))
+
+	return fa
+}
+
+func (fa *fakeV1Api) handle(rw http.ResponseWriter, req *http.Request) {
+	fa.mu.Lock()
+	defer fa.mu.Unlock()
+
+	p := strings.Split(strings.Trim(req.URL.Path, "/"), "/")
+	m := req.Method
+
+	status, out := 200, interface{}(map[string]string{"Message": "ok"})
+	notFound := func() {
+		status, out = 404, map[string]string{"Message": "not found"}
+	}
+
+	switch {
+	case len(p) == 1:
+	case p[1] == "hosts" && len(p) == 2 && m == "GET":
+		hs := []interface{}{}
+		for h := range fa.hosts {
+			hs = append(hs, fa.host(h))
+		}
+		out = map[string]interface{}{"Hosts": hs}
+	case p[1] == "hosts" && len(p) == 3 && m == "GET":
+		if _, ok := fa.hosts[p[2]]; !ok {
+			notFound()
+		} else {
+			out = fa.host(p[2])
+		}
+	case p[1] == "hosts" && len(p) == 2 && m == "POST":
+		var h vbackend.Host
+		json.NewDecoder(req.Body).Decode(&h)
+		if _, ok := fa.hosts[h.Name]; ok {
+			status, out = 409, map[string]string{"Message": "already exists"}
+		} else {
+			fa.hosts[h.Name] = map[string]*vbackend.Location{}
+			out = map[string]interface{}{"Name": h.Name}
+		}
+	case p[1] == "hosts" && len(p) == 3 && m == "DELETE":
+		if _, ok := fa.hosts[p[2]]; !ok {
+			notFound()
+		}
+		delete(fa.hosts, p[2])
+	case p[1] == "hosts" && len(p) == 4 && m == "POST":
+		var l vbackend.Location
+		json.NewDecoder(req.Body).Decode(&l)
+		if ls, ok := fa.hosts[p[2]]; !ok {
+			notFound()
+		} else if _, ok := ls[l.Id]; ok {
+			status, out = 409, map[string]string{"Message": "already exists"}
+		} else {
+			ls[l.Id] = &l
+			out = &l
+		}
+	case p[1] == "hosts" && len(p) == 5 && m == "DELETE":
+		if _, ok := fa.hosts[p[2]][p[4]]; !ok {
+			notFound()
+		}
+		delete(fa.hosts[p[2]], p[4])
+	case p[1] == "hosts" && len(p) == 7 && m == "POST" && fa.failing:
+		status, out = 500, map[string]string{"Message": "unavailable"}
+	case p[1] == "hosts" && len(p) == 7 && m == "POST":
+		var mi struct{ Id string }
+		b, _ := ioutil.ReadAll(req.Body)
+		json.Unmarshal(b, &mi)
+		k, id := p[2]+"/"+p[4], p[6]+":"+mi.Id
+		for _, e := range fa.middlewares[k] {
+			if e == id {
+				status, out = 409, map[string]string{"Message": "already exists"}
+			}
+		}
+		if status == 200 {
+			fa.middlewares[k] = append(fa.middlewares[k], id)
+			out = json.RawMessage(b)
+		}
+	case p[1] == "hosts" && len(p) == 8 && m == "PUT":
+		b, _ := ioutil.ReadAll(req.Body)
+		fa.updates++
+		out = json.RawMessage(b)
+	case p[1] == "upstreams" && len(p) == 2 && m == "GET":
+		us := []*vbackend.Upstream{}
+		for _, u := range fa.upstreams {
+			us = append(us, u)
+		}
+		out = map[string]interface{}{"Upstreams": us}
+	case p[1] == "upstreams" && len(p) == 2 && m == "POST":
+		var u vbackend.Upstream
+		json.NewDecoder(req.Body).Decode(&u)
+		if _, ok := fa.upstreams[u.Id]; ok {
+			status, out = 409, map[string]string{"Message": "already exists"}
+		} else {
+			fa.upstreams[u.Id] = &u
+			out = &u
+		}
+	case p[1] == "upstreams" && len(p) == 3:
+		u, ok := fa.upstreams[p[2]]
+		if !ok {
+			notFound()
+		} else if m == "DELETE" {
+			delete(fa.upstreams, p[2])
+		} else {
+			out = u
+		}
+	case p[1] == "upstreams" && len(p) == 4 && m == "POST":
+		var e vbackend.Endpoint
+		json.NewDecoder(req.Body).Decode(&e)
+		if u, ok := fa.upstreams[p[2]]; !ok {
+			notFound()
+		} else {
+			u.Endpoints = append(u.Endpoints, &e)
+			out = &e
+		}
+	case p[1] == "upstreams" && len(p) == 5 && m == "DELETE":
+		notFound()
+		if u, ok := fa.upstreams[p[2]]; ok {
+			for i, e := range u.Endpoints {
+				if e.Id == p[4] {
+					u.Endpoints = append(u.Endpoints[:i], u.Endpoints[i+1:]...)
+					status, out = 200, map[string]string{"Message": "deleted"}
+					break
+				}
+			}
+		}
+	default:
+		notFound()
+	}
+
+	rw.WriteHeader(status)
+	json.NewEncoder(rw).Encode(out)
+}
+
+func (fa *fakeV1Api) host(h string) interface{} {
+	locs := []*vbackend.Location{}
+	for _, l := range fa.hosts[h] {
+		l.Upstream = fa.upstreams[l.Upstream.Id]
+		locs = append(locs, l)
+	}
+
+	return map[string]interface{}{"Name": h, "Locations": locs}
+}
+
+func TestVulcandDeleteEmpty(t *testing.T) {
+	fa := newFakeV1Api()
+	defer fa.Close()
+
+	be, err := NewVulcandBackend(shared.OptionMap{"url": fa.URL, "delete_empty": "true"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	h := shared.Host("example.com")
+	e1 := *shared.NewEndpoint("http", "10.0.0.1", 80)
+	e2 := *shared.NewEndpoint("http", "10.0.0.2", 80)
+
+	for _, e := range []shared.Endpoint{e1, e2} {
+		if err := be.AddEndpoint(context.Background(), h, e); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if hl, err := be.ListHosts(context.Background()); err != nil || len((*hl)[h]) != 2 {
+		t.Logf("Unexpected hosts %v, %v", hl, err)
+		t.Fail()
+	}
+
+	if err := be.RemoveEndpoint(context.Background(), h, e1); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, ok := fa.hosts["example.com"]; !ok {
+		t.Log("Host deleted while it still has an endpoint")
+		t.Fail()
+	}
+
+	if err := be.RemoveEndpoint(context.Background(), h, e2); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(fa.hosts) != 0 || len(fa.upstreams) != 0 {
+		t.Logf("Hosts %v and upstreams %v left behind", fa.hosts, fa.upstreams)
+		t.Fail()
+	}
+}
+
+func TestVulcandKeepEmpty(t *testing.T) {
+	fa := newFakeV1Api()
+	defer fa.Close()
+
+	be, err := NewVulcandBackend(shared.OptionMap{"url": fa.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	h, e := shared.Host("example.com"), *shared.NewEndpoint("http", "10.0.0.1", 80)
+	if err := be.AddEndpoint(context.Background(), h, e); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := be.RemoveEndpoint(context.Background(), h, e); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(fa.hosts) != 1 || len(fa.upstreams) != 1 {
+		t.Logf("Expected the empty host to be kept, got %v", fa.hosts)
+		t.Fail()
+	}
+}
+
+func TestVulcandDrain(t *testing.T) {
+	fa := newFakeV1Api()
+	defer fa.Close()
+
+	be, err := NewVulcandBackend(shared.OptionMap{"url": fa.URL, "delete_empty": "true"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dr, ok := be.(backends.Drainer)
+	if !ok {
+		t.Fatal("Backend doesn't implement Drainer")
+	}
+
+	h, e := shared.Host("example.com"), *shared.NewEndpoint("http", "10.0.0.1", 80)
+	if err := be.AddEndpoint(context.Background(), h, e); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := dr.DrainEndpoint(context.Background(), h, e); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(fa.hosts) != 1 || len(fa.upstreams["example.com_up"].Endpoints) != 0 {
+		t.Logf("Expected the endpoint to be deleted and the host kept, got %v", fa.hosts)
+		t.Fail()
+	}
+
+	if err := be.RemoveEndpoint(context.Background(), h, e); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(fa.hosts) != 0 || len(fa.upstreams) != 0 {
+		t.Logf("Hosts %v and upstreams %v left behind", fa.hosts, fa.upstreams)
+		t.Fail()
+	}
+}
+
+func TestVulcandMiddlewares(t *testing.T) {
+	fa := newFakeV1Api()
+	defer fa.Close()
+
+	be, err := NewVulcandBackend(shared.OptionMap{
+		"url":                          fa.URL,
+		"middleware:example.com:limit": testRateLimit,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	h := shared.Host("example.com")
+	e := *shared.NewEndpoint("http", "10.0.0.1", 80)
+
+	// The location is created, but attaching the middleware fails
+	fa.failing = true
+	if err := be.AddEndpoint(context.Background(), h, e); err == nil {
+		t.Fatal("Failing to attach a middleware didn't fail the add")
+	}
+	fa.failing = false
+
+	// The retry attaches it to the existing location
+	for _, ip := range []string{"10.0.0.1", "10.0.0.2"} {
+		if err := be.AddEndpoint(context.Background(), h, *shared.NewEndpoint("http", ip, 80)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if ms := fa.middlewares["example.com/example.com_loc"]; len(ms) != 1 || ms[0] != "ratelimit:limit" || fa.updates != 1 {
+		t.Logf("Unexpected middlewares %v after %d updates", ms, fa.updates)
+		t.Fail()
+	}
+}
+
+func TestVulcandPaths(t *testing.T) {
+	fa := newFakeV1Api()
+	defer fa.Close()
+
+	be, err := NewVulcandBackend(shared.OptionMap{"url": fa.URL, "delete_empty": "true"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	root, api := shared.Host("example.com"), shared.Host("example.com/api")
+	e1 := *shared.NewEndpoint("http", "10.0.0.1", 80)
+	e2 := *shared.NewEndpoint("http", "10.0.0.2", 80)
+
+	if err := be.AddEndpoint(context.Background(), root, e1); err != nil {
+		t.Fatal(err)
+	}
+	if err := be.AddEndpoint(context.Background(), api, e2); err != nil {
+		t.Fatal(err)
+	}
+
+	if l := fa.hosts["example.com"]["example.com_api_loc"]; l == nil || l.Path != "/api.*" {
+		t.Logf("Unexpected location for %s: %+v", api, l)
+		t.Fail()
+	}
+
+	hl, err := be.ListHosts(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len((*hl)[root]) != 1 || len((*hl)[api]) != 1 || (*hl)[api][0].String() != e2.String() {
+		t.Logf("Unexpected hosts %v", *hl)
+		t.Fail()
+	}
+
+	if err := be.RemoveEndpoint(context.Background(), api, e2); err != nil {
+		t.Fatal(err)
+	}
+
+	if ls, ok := fa.hosts["example.com"]; !ok || len(ls) != 1 {
+		t.Logf("Expected only the location for / to be left, got %v", ls)
+		t.Fail()
+	}
+}
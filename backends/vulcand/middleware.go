@@ -0,0 +1,100 @@
+package vulcand
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/3onyc/hipdate/shared"
+	vbackend "github.com/mailgun/vulcand/backend"
+	"github.com/mailgun/vulcand/plugin"
+	"github.com/mailgun/vulcand/plugin/registry"
+	"sort"
+	"strings"
+)
+
+var (
+	InvalidMiddlewareKeyError = errors.New("middleware option must be named middleware:<host>:<id>")
+)
+
+const (
+	middlewarePrefix = "middleware:"
+	anyHost          = "*"
+)
+
+// middleware is a middleware to attach to the location or frontend of a host,
+// configured through a backend option like
+//
+//	"middleware:example.com:rl": {
+//	    "Type": "ratelimit",
+//	    "Priority": 1,
+//	    "Middleware": {"PeriodSeconds": 1, "Requests": 10, "Burst": 20, "Variable": "client.ip"}
+//	}
+//
+// with * as host attaching it to every host. The types are the ones known to
+// vulcand's plugin registry, ratelimit, connlimit, rewrite and cbreaker.
+type middleware struct {
+	Instance *vbackend.MiddlewareInstance
+	Spec     *plugin.MiddlewareSpec
+	Raw      json.RawMessage
+}
+
+type middlewareMap map[string]map[string]*middleware
+
+// parseMiddlewares validates and collects the middleware options by host.
+func parseMiddlewares(opts shared.OptionMap) (middlewareMap, error) {
+	r := registry.GetRegistry()
+	mm := middlewareMap{}
+
+	for k, v := range opts {
+		if !strings.HasPrefix(k, middlewarePrefix) {
+			continue
+		}
+
+		p := strings.Split(k[len(middlewarePrefix):], ":")
+		if len(p) != 2 || p[0] == "" || p[1] == "" {
+			return nil, InvalidMiddlewareKeyError
+		}
+
+		mi, err := vbackend.MiddlewareFromJSON([]byte(v), r.GetSpec)
+		if err != nil {
+			return nil, errors.New(k + ": " + err.Error())
+		}
+		mi.Id = p[1]
+
+		var raw struct{ Middleware json.RawMessage }
+		if err := json.Unmarshal([]byte(v), &raw); err != nil {
+			return nil, err
+		}
+
+		if mm[p[0]] == nil {
+			mm[p[0]] = map[string]*middleware{}
+		}
+		mm[p[0]][mi.Id] = &middleware{mi, r.GetSpec(mi.Type), raw.Middleware}
+	}
+
+	return mm, nil
+}
+
+// forHost returns the middlewares of a route, ordered by id. They're taken
+// from the ones for every host, the host name and the route itself, the more
+// specific ones overriding the others.
+func (mm middlewareMap) forHost(h shared.Host) []*middleware {
+	byId := map[string]*middleware{}
+	for _, k := range []string{anyHost, h.Name(), string(h)} {
+		for id, m := range mm[k] {
+			byId[id] = m
+		}
+	}
+
+	ids := []string{}
+	for id := range byId {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	ms := []*middleware{}
+	for _, id := range ids {
+		ms = append(ms, byId[id])
+	}
+
+	return ms
+}
@@ -0,0 +1,56 @@
+package vulcand
+
+import (
+	"github.com/3onyc/hipdate/shared"
+	"testing"
+)
+
+const (
+	testRateLimit = `{
+		"Type": "ratelimit",
+		"Priority": 1,
+		"Middleware": {"PeriodSeconds": 1, "Requests": 10, "Burst": 20, "Variable": "client.ip"}
+	}`
+	testConnLimit = `{
+		"Type": "connlimit",
+		"Middleware": {"Connections": 5, "Variable": "client.ip"}
+	}`
+)
+
+func TestParseMiddlewares(t *testing.T) {
+	mm, err := parseMiddlewares(shared.OptionMap{
+		"url":                            "http://localhost:8182",
+		"middleware:*:limit":             testConnLimit,
+		"middleware:example.com:limit":   testRateLimit,
+		"middleware:example.com:connlim": testConnLimit,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ms := mm.forHost("example.com")
+	if len(ms) != 2 || ms[0].Instance.Id != "connlim" || ms[1].Instance.Type != "ratelimit" {
+		t.Logf("Unexpected middlewares for example.com %+v", ms)
+		t.Fail()
+	}
+
+	if ms := mm.forHost("other.com"); len(ms) != 1 || ms[0].Instance.Type != "connlimit" {
+		t.Logf("Unexpected middlewares for other.com %+v", ms)
+		t.Fail()
+	}
+}
+
+func TestParseMiddlewaresErrors(t *testing.T) {
+	invalid := []shared.OptionMap{
+		{"middleware:example.com": testRateLimit},
+		{"middleware:example.com:x": `{"Type": "unknown", "Middleware": {}}`},
+		{"middleware:example.com:x": `{"Type": "ratelimit", "Middleware": {"Requests": 0}}`},
+	}
+
+	for _, opts := range invalid {
+		if _, err := parseMiddlewares(opts); err == nil {
+			t.Logf("Expected an error for %v", opts)
+			t.Fail()
+		}
+	}
+}
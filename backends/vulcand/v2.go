@@ -0,0 +1,230 @@
+package vulcand
+
+import (
+	"context"
+	"fmt"
+	"github.com/3onyc/hipdate/shared"
+	"log"
+	"regexp"
+	"strings"
+)
+
+var (
+	hostRouteRegexp = regexp.MustCompile("Host\\([`\"]([^`\"]+)[`\"]\\)")
+	pathRouteRegexp = regexp.MustCompile("PathRegexp\\([`\"]([^`\"]+)[`\"]\\)")
+)
+
+// VulcandV2Backend writes the routes as frontends, backends and servers, the
+// model used by vulcand's v2 API. Every route gets a frontend <route>_fe
+// routing to the backend <route>_be, where the route is the host with any
+// slashes of its path replaced by underscores.
+type VulcandV2Backend struct {
+	c           *client
+	deleteEmpty bool
+	middlewares middlewareMap
+}
+
+func NewVulcandV2Backend(eu string, opts shared.OptionMap) (*VulcandV2Backend, error) {
+	mm, err := parseMiddlewares(opts)
+	if err != nil {
+		return nil, err
+	}
+
+	c := newClient(eu)
+
+	// Check if vulcand is reachable
+	if err := c.status(context.Background()); err != nil {
+		return nil, err
+	}
+
+	return &VulcandV2Backend{
+		c:           c,
+		deleteEmpty: opts["delete_empty"] == "true",
+		middlewares: mm,
+	}, nil
+}
+
+func (vb *VulcandV2Backend) AddEndpoint(
+	ctx context.Context,
+	h shared.Host,
+	e shared.Endpoint,
+) error {
+	bId, fId := backendId(h), frontendId(h)
+
+	if err := vb.c.upsertBackend(ctx, backend{Id: bId, Type: "http"}); err != nil {
+		return err
+	}
+
+	if err := vb.c.upsertServer(ctx, bId, server{Id: serverId(e), URL: e.String()}); err != nil {
+		return err
+	}
+
+	err := vb.c.upsertFrontend(ctx, frontend{
+		Id:        fId,
+		Type:      "http",
+		BackendId: bId,
+		Route:     hostRoute(h),
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, m := range vb.middlewares.forHost(h) {
+		err := vb.c.upsertMiddleware(ctx, fId, frontendMiddleware{
+			Id:         m.Instance.Id,
+			Priority:   m.Instance.Priority,
+			Type:       m.Instance.Type,
+			Middleware: m.Raw,
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (vb *VulcandV2Backend) RemoveEndpoint(
+	ctx context.Context,
+	h shared.Host,
+	e shared.Endpoint,
+) error {
+	if err := vb.c.deleteServer(ctx, backendId(h), serverId(e)); err != nil && !isNotFound(err) {
+		return err
+	}
+
+	if vb.deleteEmpty {
+		return vb.deleteIfEmpty(ctx, h)
+	}
+
+	return nil
+}
+
+// DrainEndpoint deletes the server so vulcand stops sending it new requests,
+// the ones in flight are left to finish. The frontend and backend are kept
+// even if they're left empty, the route is removed later.
+func (vb *VulcandV2Backend) DrainEndpoint(
+	ctx context.Context,
+	h shared.Host,
+	e shared.Endpoint,
+) error {
+	if err := vb.c.deleteServer(ctx, backendId(h), serverId(e)); err != nil && !isNotFound(err) {
+		return err
+	}
+
+	log.Println("DEBUG [backend:vulcand] Endpoint drained", h, e.String())
+	return nil
+}
+
+// deleteIfEmpty deletes the frontend and backend of a host without servers.
+func (vb *VulcandV2Backend) deleteIfEmpty(ctx context.Context, h shared.Host) error {
+	ss, err := vb.c.servers(ctx, backendId(h))
+	if isNotFound(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	if len(ss) > 0 {
+		return nil
+	}
+
+	if err := vb.c.deleteFrontend(ctx, frontendId(h)); err != nil && !isNotFound(err) {
+		return err
+	}
+
+	if err := vb.c.deleteBackend(ctx, backendId(h)); err != nil && !isNotFound(err) {
+		return err
+	}
+
+	log.Println("DEBUG [backend:vulcand] Empty host deleted", h)
+	return nil
+}
+
+func (vb *VulcandV2Backend) Initialise(ctx context.Context) error {
+	fs, err := vb.c.frontends(ctx)
+	if err != nil {
+		return err
+	}
+
+	for _, f := range fs {
+		if err := vb.c.deleteFrontend(ctx, f.Id); err != nil && !isNotFound(err) {
+			return err
+		}
+	}
+
+	bs, err := vb.c.backends(ctx)
+	if err != nil {
+		return err
+	}
+
+	for _, b := range bs {
+		if err := vb.c.deleteBackend(ctx, b.Id); err != nil && !isNotFound(err) {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (vb *VulcandV2Backend) ListHosts(ctx context.Context) (*shared.HostList, error) {
+	hl := shared.HostList{}
+
+	fs, err := vb.c.frontends(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, f := range fs {
+		m := hostRouteRegexp.FindStringSubmatch(f.Route)
+		if m == nil {
+			continue
+		}
+
+		path := ""
+		if pm := pathRouteRegexp.FindStringSubmatch(f.Route); pm != nil {
+			path = regexpPath(pm[1])
+		}
+
+		h := shared.NewHost(m[1], path)
+		if _, ok := hl[h]; !ok {
+			hl[h] = []shared.Endpoint{}
+		}
+
+		ss, err := vb.c.servers(ctx, f.BackendId)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, s := range ss {
+			e, err := shared.NewEndpointFromUrl(s.URL)
+			if err != nil {
+				log.Printf("WARN Couldn't decode URL %s, %s", s.URL, err)
+				continue
+			}
+			hl[h] = append(hl[h], *e)
+		}
+	}
+
+	return &hl, nil
+}
+
+func frontendId(h shared.Host) string {
+	return routeId(h) + "_fe"
+}
+
+func backendId(h shared.Host) string {
+	return routeId(h) + "_be"
+}
+
+func serverId(e shared.Endpoint) string {
+	return "srv_" + e.Hash()
+}
+
+func hostRoute(h shared.Host) string {
+	return fmt.Sprintf(
+		"Host(`%s`) && PathRegexp(`%s`)",
+		strings.Replace(h.Name(), "`", "", -1),
+		strings.Replace(pathRegexp(h), "`", "", -1),
+	)
+}
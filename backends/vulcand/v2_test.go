@@ -0,0 +1,294 @@
+package vulcand
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/3onyc/hipdate/shared"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakeApi keeps the frontends, backends and servers posted to it in memory,
+// like vulcand's v2 API.
+type fakeApi struct {
+	*httptest.Server
+	mu          sync.Mutex
+	frontends   map[string]frontend
+	backends    map[string]backend
+	servers     map[string]map[string]server
+	middlewares map[string]map[string]frontendMiddleware
+}
+
+func newFakeApi() *fakeApi {
+	fa := &fakeApi{
+		frontends:   map[string]frontend{},
+		backends:    map[string]backend{},
+		servers:     map[string]map[string]server{},
+		middlewares: map[string]map[string]frontendMiddleware{},
+	}
+	fa.Server = httptest.NewServer(http.HandlerFunc(fa.handle))
+
+	return fa
+}
+
+func (fa *fakeApi) handle(rw http.ResponseWriter, req *http.Request) {
+	fa.mu.Lock()
+	defer fa.mu.Unlock()
+
+	p := strings.Split(strings.Trim(req.URL.Path, "/"), "/")
+	if len(p) < 2 || p[0] != "v2" {
+		http.NotFound(rw, req)
+		return
+	}
+
+	var in struct {
+		Frontend   frontend
+		Backend    backend
+		Server     server
+		Middleware frontendMiddleware
+	}
+	if req.Method == "POST" {
+		json.NewDecoder(req.Body).Decode(&in)
+	}
+
+	found := true
+	var out interface{}
+	switch {
+	case p[1] == "status":
+		out = map[string]string{"Status": "ok"}
+	case p[1] == "frontends" && len(p) == 2 && req.Method == "GET":
+		fs := []frontend{}
+		for _, f := range fa.frontends {
+			fs = append(fs, f)
+		}
+		out = map[string][]frontend{"Frontends": fs}
+	case p[1] == "frontends" && len(p) == 2 && req.Method == "POST":
+		fa.frontends[in.Frontend.Id] = in.Frontend
+	case p[1] == "frontends" && len(p) == 3 && req.Method == "DELETE":
+		_, found = fa.frontends[p[2]]
+		delete(fa.frontends, p[2])
+	case p[1] == "frontends" && len(p) == 4 && req.Method == "POST":
+		if _, found = fa.frontends[p[2]]; found {
+			if fa.middlewares[p[2]] == nil {
+				fa.middlewares[p[2]] = map[string]frontendMiddleware{}
+			}
+			fa.middlewares[p[2]][in.Middleware.Id] = in.Middleware
+		}
+	case p[1] == "backends" && len(p) == 2 && req.Method == "GET":
+		bs := []backend{}
+		for _, b := range fa.backends {
+			bs = append(bs, b)
+		}
+		out = map[string][]backend{"Backends": bs}
+	case p[1] == "backends" && len(p) == 2 && req.Method == "POST":
+		fa.backends[in.Backend.Id] = in.Backend
+	case p[1] == "backends" && len(p) == 3 && req.Method == "DELETE":
+		_, found = fa.backends[p[2]]
+		delete(fa.backends, p[2])
+		delete(fa.servers, p[2])
+	case p[1] == "backends" && len(p) == 4 && req.Method == "GET":
+		ss := []server{}
+		for _, s := range fa.servers[p[2]] {
+			ss = append(ss, s)
+		}
+		out = map[string][]server{"Servers": ss}
+	case p[1] == "backends" && len(p) == 4 && req.Method == "POST":
+		if _, found = fa.backends[p[2]]; found {
+			if fa.servers[p[2]] == nil {
+				fa.servers[p[2]] = map[string]server{}
+			}
+			fa.servers[p[2]][in.Server.Id] = in.Server
+		}
+	case p[1] == "backends" && len(p) == 5 && req.Method == "DELETE":
+		_, found = fa.servers[p[2]][p[4]]
+		delete(fa.servers[p[2]], p[4])
+	default:
+		found = false
+	}
+
+	if !found {
+		rw.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(rw).Encode(map[string]string{"message": "not found"})
+		return
+	}
+
+	if out == nil {
+		out = map[string]string{"message": "ok"}
+	}
+	json.NewEncoder(rw).Encode(out)
+}
+
+func newTestV2Backend(t *testing.T, fa *fakeApi) *VulcandV2Backend {
+	be, err := NewVulcandBackend(shared.OptionMap{"url": fa.URL, "mode": "v2"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return be.(*VulcandV2Backend)
+}
+
+func TestVulcandV2AddAndList(t *testing.T) {
+	fa := newFakeApi()
+	defer fa.Close()
+
+	vb := newTestV2Backend(t, fa)
+	h := shared.Host("example.com")
+	e1 := *shared.NewEndpoint("http", "10.0.0.1", 80)
+	e2 := *shared.NewEndpoint("http", "10.0.0.2", 80)
+
+	for _, e := range []shared.Endpoint{e1, e2, e1} {
+		if err := vb.AddEndpoint(context.Background(), h, e); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if f := fa.frontends["example.com_fe"]; f.BackendId != "example.com_be" ||
+		f.Route != "Host(`example.com`) && PathRegexp(`/.*`)" {
+		t.Logf("Unexpected frontend %+v", f)
+		t.Fail()
+	}
+
+	hl, err := vb.ListHosts(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len((*hl)[h]) != 2 {
+		t.Logf("Expected 2 endpoints for %s, got %v", h, (*hl)[h])
+		t.Fail()
+	}
+
+	if err := vb.RemoveEndpoint(context.Background(), h, e2); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := vb.RemoveEndpoint(context.Background(), h, e2); err != nil {
+		t.Logf("Removing a missing endpoint failed: %s", err)
+		t.Fail()
+	}
+
+	if hl, _ := vb.ListHosts(context.Background()); len((*hl)[h]) != 1 || (*hl)[h][0].String() != e1.String() {
+		t.Logf("Unexpected endpoints after removal %v", (*hl)[h])
+		t.Fail()
+	}
+}
+
+func TestVulcandV2Initialise(t *testing.T) {
+	fa := newFakeApi()
+	defer fa.Close()
+
+	vb := newTestV2Backend(t, fa)
+	if err := vb.AddEndpoint(context.Background(), "example.com", *shared.NewEndpoint("http", "10.0.0.1", 80)); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := vb.Initialise(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(fa.frontends) != 0 || len(fa.backends) != 0 {
+		t.Logf("Frontends %v and backends %v left", fa.frontends, fa.backends)
+		t.Fail()
+	}
+}
+
+func TestVulcandV2DeleteEmpty(t *testing.T) {
+	fa := newFakeApi()
+	defer fa.Close()
+
+	be, err := NewVulcandBackend(shared.OptionMap{"url": fa.URL, "mode": "v2", "delete_empty": "true"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	h, e := shared.Host("example.com"), *shared.NewEndpoint("http", "10.0.0.1", 80)
+	if err := be.AddEndpoint(context.Background(), h, e); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := be.RemoveEndpoint(context.Background(), h, e); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(fa.frontends) != 0 || len(fa.backends) != 0 {
+		t.Logf("Frontends %v and backends %v left behind", fa.frontends, fa.backends)
+		t.Fail()
+	}
+}
+
+func TestVulcandV2Drain(t *testing.T) {
+	fa := newFakeApi()
+	defer fa.Close()
+
+	be := newTestV2Backend(t, fa)
+	h, e := shared.Host("example.com"), *shared.NewEndpoint("http", "10.0.0.1", 80)
+	if err := be.AddEndpoint(context.Background(), h, e); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := be.DrainEndpoint(context.Background(), h, e); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(fa.frontends) != 1 || len(fa.servers[backendId(h)]) != 0 {
+		t.Logf("Expected the server to be deleted and the frontend kept, got %v", fa.servers)
+		t.Fail()
+	}
+
+	if err := be.RemoveEndpoint(context.Background(), h, e); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestVulcandV2Middlewares(t *testing.T) {
+	fa := newFakeApi()
+	defer fa.Close()
+
+	be, err := NewVulcandBackend(shared.OptionMap{
+		"url":                fa.URL,
+		"mode":               "v2",
+		"middleware:*:limit": testConnLimit,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := be.AddEndpoint(context.Background(), "example.com", *shared.NewEndpoint("http", "10.0.0.1", 80)); err != nil {
+		t.Fatal(err)
+	}
+
+	m, ok := fa.middlewares["example.com_fe"]["limit"]
+	if !ok || m.Type != "connlimit" || !strings.Contains(string(m.Middleware), `"Connections"`) {
+		t.Logf("Unexpected middlewares %v", fa.middlewares)
+		t.Fail()
+	}
+}
+
+func TestVulcandV2Paths(t *testing.T) {
+	fa := newFakeApi()
+	defer fa.Close()
+
+	vb := newTestV2Backend(t, fa)
+	h, e := shared.Host("example.com/api/v1"), *shared.NewEndpoint("http", "10.0.0.1", 80)
+	if err := vb.AddEndpoint(context.Background(), h, e); err != nil {
+		t.Fatal(err)
+	}
+
+	if f := fa.frontends["example.com_api_v1_fe"]; f.Route != "Host(`example.com`) && PathRegexp(`/api/v1.*`)" {
+		t.Logf("Unexpected frontend %+v", f)
+		t.Fail()
+	}
+
+	hl, err := vb.ListHosts(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len((*hl)[h]) != 1 {
+		t.Logf("Unexpected hosts %v", *hl)
+		t.Fail()
+	}
+}
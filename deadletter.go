@@ -0,0 +1,132 @@
+package hipdate
+
+import (
+	"github.com/3onyc/hipdate/shared"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultDeadLetterSize = 1000
+)
+
+// DeadLetter is a change event that still failed after all retries.
+type DeadLetter struct {
+	Id       uint64
+	Time     time.Time
+	Event    *shared.ChangeEvent
+	Attempts int
+	Error    string
+}
+
+// DeadLetterQueue holds the events that couldn't be applied, until they're
+// replayed. Once full, the oldest events are dropped.
+type DeadLetterQueue struct {
+	mu      sync.Mutex
+	seq     uint64
+	size    int
+	letters []*DeadLetter
+	replays chan []*DeadLetter
+}
+
+func NewDeadLetterQueue(size int) *DeadLetterQueue {
+	if size < 1 {
+		size = DefaultDeadLetterSize
+	}
+
+	return &DeadLetterQueue{
+		size:    size,
+		letters: []*DeadLetter{},
+		replays: make(chan []*DeadLetter),
+	}
+}
+
+func (dlq *DeadLetterQueue) Add(ce *shared.ChangeEvent, attempts int, err error) *DeadLetter {
+	dlq.mu.Lock()
+	defer dlq.mu.Unlock()
+
+	dlq.seq++
+	dl := &DeadLetter{
+		Id:       dlq.seq,
+		Time:     time.Now(),
+		Event:    ce,
+		Attempts: attempts,
+		Error:    err.Error(),
+	}
+
+	dlq.letters = append(dlq.letters, dl)
+	if len(dlq.letters) > dlq.size {
+		dlq.letters = dlq.letters[len(dlq.letters)-dlq.size:]
+	}
+
+	return dl
+}
+
+func (dlq *DeadLetterQueue) List() []*DeadLetter {
+	dlq.mu.Lock()
+	defer dlq.mu.Unlock()
+
+	return append([]*DeadLetter{}, dlq.letters...)
+}
+
+func (dlq *DeadLetterQueue) Len() int {
+	dlq.mu.Lock()
+	defer dlq.mu.Unlock()
+
+	return len(dlq.letters)
+}
+
+// Take removes and returns the dead letter with the given id, or all of them
+// if id is 0.
+func (dlq *DeadLetterQueue) Take(id uint64) []*DeadLetter {
+	dlq.mu.Lock()
+	defer dlq.mu.Unlock()
+
+	taken, kept := []*DeadLetter{}, []*DeadLetter{}
+	for _, dl := range dlq.letters {
+		if id == 0 || dl.Id == id {
+			taken = append(taken, dl)
+		} else {
+			kept = append(kept, dl)
+		}
+	}
+	dlq.letters = kept
+
+	return taken
+}
+
+// Drop removes the dead letters for the route of h and e, and returns how
+// many it removed. A newer event for a route supersedes its dead letters.
+func (dlq *DeadLetterQueue) Drop(h shared.Host, e shared.Endpoint) int {
+	dlq.mu.Lock()
+	defer dlq.mu.Unlock()
+
+	kept := []*DeadLetter{}
+	for _, dl := range dlq.letters {
+		if dl.Event.Host != h || dl.Event.Endpoint.Bare() != e.Bare() {
+			kept = append(kept, dl)
+		}
+	}
+
+	n := len(dlq.letters) - len(kept)
+	dlq.letters = kept
+
+	return n
+}
+
+// Requeue puts dead letters that were taken but couldn't be replayed back
+// in the queue.
+func (dlq *DeadLetterQueue) Requeue(dls []*DeadLetter) {
+	dlq.mu.Lock()
+	defer dlq.mu.Unlock()
+
+	dlq.letters = append(dls, dlq.letters...)
+	if len(dlq.letters) > dlq.size {
+		dlq.letters = dlq.letters[len(dlq.letters)-dlq.size:]
+	}
+}
+
+// Replays delivers the dead letters that should be applied again.
+func (dlq *DeadLetterQueue) Replays() chan []*DeadLetter {
+	return dlq.replays
+}
@@ -0,0 +1,51 @@
+package hipdate
+
+import (
+	"errors"
+	"github.com/3onyc/hipdate/shared"
+	"testing"
+)
+
+func TestDeadLetterQueueBounded(t *testing.T) {
+	dlq := NewDeadLetterQueue(2)
+	for i := 0; i < 3; i++ {
+		dlq.Add(testEvent(), 5, errors.New("boom"))
+	}
+
+	dls := dlq.List()
+	if len(dls) != 2 || dls[0].Id != 2 || dls[1].Id != 3 {
+		t.Logf("Unexpected dead letters %v", dls)
+		t.Fail()
+	}
+}
+
+func TestDeadLetterQueueTake(t *testing.T) {
+	dlq := NewDeadLetterQueue(10)
+	for i := 0; i < 3; i++ {
+		dlq.Add(testEvent(), 5, errors.New("boom"))
+	}
+
+	if dls := dlq.Take(2); len(dls) != 1 || dls[0].Id != 2 || dlq.Len() != 2 {
+		t.Logf("Unexpected result taking id 2: %v, %d left", dls, dlq.Len())
+		t.Fail()
+	}
+
+	if dls := dlq.Take(0); len(dls) != 2 || dlq.Len() != 0 {
+		t.Logf("Unexpected result taking all: %v, %d left", dls, dlq.Len())
+		t.Fail()
+	}
+}
+
+func TestDeadLetterQueueDrop(t *testing.T) {
+	dlq := NewDeadLetterQueue(10)
+	dlq.Add(testEvent(), 5, errors.New("boom"))
+	other := shared.NewChangeEvent(shared.EventAdd, "example.com", *shared.NewEndpoint("http", "10.0.0.2", 80))
+	dlq.Add(other, 5, errors.New("boom"))
+
+	ep := *shared.NewEndpoint("http", "10.0.0.1", 80)
+	ep.Weight = 3
+	if n := dlq.Drop("example.com", ep); n != 1 || dlq.Len() != 1 || dlq.List()[0].Event != other {
+		t.Logf("Unexpected result dropping the route: %d dropped, %v left", n, dlq.List())
+		t.Fail()
+	}
+}
@@ -0,0 +1,85 @@
+package hipdate
+
+import (
+	"github.com/3onyc/hipdate/shared"
+	"sync"
+	"time"
+)
+
+// DriftReport lists the differences between the routes hipdated believes it
+// applied and the ones the backend actually has.
+type DriftReport struct {
+	Time       time.Time
+	Missing    shared.HostList
+	Unexpected shared.HostList
+	Repaired   bool
+	Error      string `json:",omitempty"`
+}
+
+// ComputeDrift compares the desired routes with the actual ones, hosts
+// without endpoints are ignored since backends may keep those around.
+func ComputeDrift(desired, actual shared.HostList) *DriftReport {
+	return &DriftReport{
+		Time:       time.Now(),
+		Missing:    subtractHosts(desired, actual),
+		Unexpected: subtractHosts(actual, desired),
+	}
+}
+
+func (dr *DriftReport) InSync() bool {
+	return dr.Error == "" && len(dr.Missing) == 0 && len(dr.Unexpected) == 0
+}
+
+func (dr *DriftReport) Count() (missing, unexpected int) {
+	for _, eps := range dr.Missing {
+		missing += len(eps)
+	}
+	for _, eps := range dr.Unexpected {
+		unexpected += len(eps)
+	}
+
+	return missing, unexpected
+}
+
+// subtractHosts returns the endpoints in a that aren't in b.
+func subtractHosts(a, b shared.HostList) shared.HostList {
+	d := shared.HostList{}
+	for h, eps := range a {
+		in := map[string]bool{}
+		for _, e := range b[h] {
+			in[e.String()] = true
+		}
+
+		for _, e := range eps {
+			if !in[e.String()] {
+				d[h] = append(d[h], e)
+			}
+		}
+	}
+
+	return d
+}
+
+// DriftDetector holds the most recent drift report.
+type DriftDetector struct {
+	mu   sync.RWMutex
+	last *DriftReport
+}
+
+func NewDriftDetector() *DriftDetector {
+	return &DriftDetector{}
+}
+
+func (dd *DriftDetector) Set(dr *DriftReport) {
+	dd.mu.Lock()
+	defer dd.mu.Unlock()
+
+	dd.last = dr
+}
+
+func (dd *DriftDetector) Last() *DriftReport {
+	dd.mu.RLock()
+	defer dd.mu.RUnlock()
+
+	return dd.last
+}
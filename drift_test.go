@@ -0,0 +1,49 @@
+package hipdate
+
+import (
+	"github.com/3onyc/hipdate/shared"
+	"testing"
+)
+
+func TestComputeDrift(t *testing.T) {
+	e1 := *shared.NewEndpoint("http", "10.0.0.1", 80)
+	e2 := *shared.NewEndpoint("http", "10.0.0.2", 80)
+	e3 := *shared.NewEndpoint("http", "10.0.0.3", 80)
+
+	desired := shared.HostList{
+		"a.com": {e1, e2},
+		"b.com": {e3},
+	}
+	actual := shared.HostList{
+		"a.com": {e1, e3},
+		"c.com": {},
+	}
+
+	dr := ComputeDrift(desired, actual)
+	if dr.InSync() {
+		t.Fatal("Drifted routes reported in sync")
+	}
+
+	if len(dr.Missing["a.com"]) != 1 || dr.Missing["a.com"][0] != e2 || len(dr.Missing["b.com"]) != 1 {
+		t.Logf("Unexpected missing routes %v", dr.Missing)
+		t.Fail()
+	}
+
+	if len(dr.Unexpected) != 1 || len(dr.Unexpected["a.com"]) != 1 || dr.Unexpected["a.com"][0] != e3 {
+		t.Logf("Unexpected unexpected routes %v", dr.Unexpected)
+		t.Fail()
+	}
+
+	if m, u := dr.Count(); m != 2 || u != 1 {
+		t.Logf("Unexpected counts %d, %d", m, u)
+		t.Fail()
+	}
+}
+
+func TestComputeDriftInSync(t *testing.T) {
+	hl := shared.HostList{"a.com": {*shared.NewEndpoint("http", "10.0.0.1", 80)}}
+	if dr := ComputeDrift(hl, hl); !dr.InSync() {
+		t.Logf("Identical routes reported as drifted %+v", dr)
+		t.Fail()
+	}
+}
@@ -0,0 +1,108 @@
+package hipdate
+
+import (
+	"github.com/3onyc/hipdate/shared"
+	"sync"
+	"time"
+)
+
+const (
+	ResultApplied = "applied"
+	ResultSkipped = "skipped"
+	ResultFailed  = "failed"
+	ResultHeld    = "held"
+
+	subscriberBuffer = 64
+)
+
+// EventRecord is a processed change event, along with the outcome of
+// applying it to the backend.
+type EventRecord struct {
+	Id       uint64
+	Seq      uint64
+	Time     time.Time
+	Source   string
+	Type     string
+	Host     shared.Host
+	Endpoint string
+	Weight   int    `json:",omitempty"`
+	Tags     string `json:",omitempty"`
+	Origin   string `json:",omitempty"`
+	Result   string
+	Error    string `json:",omitempty"`
+	Attempt  int    `json:",omitempty"`
+}
+
+func NewEventRecord(ce *shared.ChangeEvent, res string, err error) *EventRecord {
+	r := &EventRecord{
+		Seq:      ce.Seq,
+		Time:     time.Now(),
+		Source:   ce.Source,
+		Type:     ce.Type.String(),
+		Host:     ce.Host,
+		Endpoint: ce.Endpoint.String(),
+		Weight:   ce.Endpoint.Weight,
+		Tags:     ce.Endpoint.Tags,
+		Origin:   ce.Endpoint.Origin.Id,
+		Result:   res,
+	}
+
+	if err != nil {
+		r.Error = err.Error()
+	}
+
+	return r
+}
+
+// EventBroker fans processed events out to subscribers without ever
+// blocking the publisher, subscribers that fall behind are dropped.
+type EventBroker struct {
+	mu   sync.Mutex
+	seq  uint64
+	subs map[chan *EventRecord]bool
+}
+
+func NewEventBroker() *EventBroker {
+	return &EventBroker{
+		subs: map[chan *EventRecord]bool{},
+	}
+}
+
+func (eb *EventBroker) Publish(r *EventRecord) {
+	eb.mu.Lock()
+	defer eb.mu.Unlock()
+
+	eb.seq++
+	r.Id = eb.seq
+
+	for ch := range eb.subs {
+		select {
+		case ch <- r:
+		default:
+			delete(eb.subs, ch)
+			close(ch)
+		}
+	}
+}
+
+// Subscribe returns a channel receiving all events published from now on,
+// it's closed when the subscriber can't keep up.
+func (eb *EventBroker) Subscribe() chan *EventRecord {
+	eb.mu.Lock()
+	defer eb.mu.Unlock()
+
+	ch := make(chan *EventRecord, subscriberBuffer)
+	eb.subs[ch] = true
+
+	return ch
+}
+
+func (eb *EventBroker) Unsubscribe(ch chan *EventRecord) {
+	eb.mu.Lock()
+	defer eb.mu.Unlock()
+
+	if eb.subs[ch] {
+		delete(eb.subs, ch)
+		close(ch)
+	}
+}
@@ -0,0 +1,95 @@
+package hipdate
+
+import (
+	"bufio"
+	"errors"
+	"github.com/3onyc/hipdate/shared"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func testEvent() *shared.ChangeEvent {
+	ce := shared.NewChangeEvent(shared.EventAdd, "example.com", *shared.NewEndpoint("http", "10.0.0.1", 80))
+	ce.Source = "docker"
+	return ce
+}
+
+func TestEventBrokerDropsSlowSubscribers(t *testing.T) {
+	eb := NewEventBroker()
+	slow := eb.Subscribe()
+	fast := eb.Subscribe()
+
+	done := make(chan bool)
+	go func() {
+		for i := 0; i < subscriberBuffer+1; i++ {
+			eb.Publish(NewEventRecord(testEvent(), ResultApplied, nil))
+			<-fast
+		}
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("Publish blocked on a slow subscriber")
+	}
+
+	n := 0
+	for _ = range slow {
+		n++
+	}
+
+	if n != subscriberBuffer {
+		t.Logf("Expected %d buffered events before drop, got %d", subscriberBuffer, n)
+		t.Fail()
+	}
+}
+
+func TestEventRecordError(t *testing.T) {
+	r := NewEventRecord(testEvent(), ResultFailed, errors.New("boom"))
+	if r.Error != "boom" || r.Endpoint != "http://10.0.0.1:80" || r.Source != "docker" {
+		t.Logf("Unexpected record %+v", r)
+		t.Fail()
+	}
+}
+
+func TestHttpServerEventStream(t *testing.T) {
+	hs, err := NewHttpServer(&fakeBackend{shared.HostList{}}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hs.Events = NewEventBroker()
+
+	ts := httptest.NewServer(hs)
+	defer ts.Close()
+
+	resp, err := http.Get(ts.URL + "/api/v1/events")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	if ct := resp.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Fatalf("Unexpected content type '%s'", ct)
+	}
+
+	hs.Events.Publish(NewEventRecord(testEvent(), ResultApplied, nil))
+
+	r := bufio.NewReader(resp.Body)
+	lines := []string{}
+	for len(lines) < 3 {
+		l, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		lines = append(lines, strings.TrimSpace(l))
+	}
+
+	if lines[0] != "id: 1" || lines[1] != "event: change" || !strings.Contains(lines[2], `"Result":"applied"`) {
+		t.Logf("Unexpected event %v", lines)
+		t.Fail()
+	}
+}
@@ -0,0 +1,91 @@
+package hipdate
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultLivenessTimeout is how long the event loop may go without a
+	// heartbeat before hipdated is considered dead.
+	DefaultLivenessTimeout = time.Minute
+)
+
+type ComponentStatus struct {
+	Ready bool
+	Error string `json:",omitempty"`
+	Since time.Time
+}
+
+// Health keeps track of the readiness of the backend and the sources, and of
+// the heartbeat of the main event loop.
+type Health struct {
+	mu         sync.RWMutex
+	beat       time.Time
+	components map[string]ComponentStatus
+}
+
+func NewHealth() *Health {
+	return &Health{
+		beat:       time.Now(),
+		components: map[string]ComponentStatus{},
+	}
+}
+
+// Set updates the status of a component, and returns whether its readiness
+// changed.
+func (h *Health) Set(name string, ready bool, err error) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	cs := ComponentStatus{Ready: ready && err == nil}
+	if err != nil {
+		cs.Error = err.Error()
+	}
+
+	old, ok := h.components[name]
+	if ok && old.Ready == cs.Ready && old.Error == cs.Error {
+		return false
+	}
+
+	cs.Since = time.Now()
+	h.components[name] = cs
+
+	return !ok || old.Ready != cs.Ready
+}
+
+func (h *Health) Remove(name string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	delete(h.components, name)
+}
+
+func (h *Health) Beat() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.beat = time.Now()
+}
+
+func (h *Health) Alive() bool {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	return time.Since(h.beat) < DefaultLivenessTimeout
+}
+
+// Ready returns whether all components are ready, along with their status.
+func (h *Health) Ready() (bool, map[string]ComponentStatus) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	ready := len(h.components) > 0
+	cs := map[string]ComponentStatus{}
+	for n, s := range h.components {
+		cs[n] = s
+		ready = ready && s.Ready
+	}
+
+	return ready, cs
+}
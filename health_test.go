@@ -0,0 +1,91 @@
+package hipdate
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestHealthReady(t *testing.T) {
+	h := NewHealth()
+	if ready, _ := h.Ready(); ready {
+		t.Log("Ready without any components")
+		t.Fail()
+	}
+
+	if !h.Set("backend", true, nil) {
+		t.Log("New component not reported as changed")
+		t.Fail()
+	}
+	h.Set("source:docker", false, nil)
+
+	if ready, _ := h.Ready(); ready {
+		t.Log("Ready while a source hasn't synced")
+		t.Fail()
+	}
+
+	h.Set("source:docker", true, nil)
+	if ready, _ := h.Ready(); !ready {
+		t.Log("Not ready while all components are")
+		t.Fail()
+	}
+
+	if !h.Set("source:docker", true, errors.New("lost connection")) {
+		t.Log("Failing component not reported as changed")
+		t.Fail()
+	}
+
+	ready, cs := h.Ready()
+	if ready || cs["source:docker"].Error != "lost connection" {
+		t.Logf("Unexpected status %v", cs)
+		t.Fail()
+	}
+
+	h.Remove("source:docker")
+	if ready, _ := h.Ready(); !ready {
+		t.Log("Removed component still affects readiness")
+		t.Fail()
+	}
+}
+
+func TestHttpServerReadyz(t *testing.T) {
+	hs, err := NewHttpServer(&fakeBackend{}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hs.Health = NewHealth()
+	hs.Health.Set("backend", false, nil)
+
+	ts := httptest.NewServer(hs)
+	defer ts.Close()
+
+	for _, c := range []struct {
+		ready  bool
+		status int
+	}{{false, 503}, {true, 200}} {
+		hs.Health.Set("backend", c.ready, nil)
+
+		resp, err := http.Get(ts.URL + "/readyz")
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+
+		if resp.StatusCode != c.status {
+			t.Logf("Expected %d with ready=%t, got %d", c.status, c.ready, resp.StatusCode)
+			t.Fail()
+		}
+	}
+
+	resp, err := http.Get(ts.URL + "/healthz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != 200 {
+		t.Logf("Expected healthz 200, got %d", resp.StatusCode)
+		t.Fail()
+	}
+}
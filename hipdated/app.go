@@ -1,99 +1,1242 @@
 package main
 
 import (
+	"context"
 	"github.com/3onyc/hipdate"
 	"github.com/3onyc/hipdate/backends"
+	"github.com/3onyc/hipdate/metrics"
 	"github.com/3onyc/hipdate/shared"
 	"github.com/3onyc/hipdate/sources"
+	"io"
 	"log"
+	"strconv"
+	"strings"
 	"sync"
+	"time"
 )
 
+const (
+	DefaultReloadGrace    = 10 * time.Second
+	DefaultHealthInterval = 30 * time.Second
+	DefaultDriftInterval  = time.Minute
+	DefaultRetryMax       = 5
+	DefaultRetryBackoff   = time.Second
+	DefaultRetryMaxDelay  = time.Minute
+
+	DefaultBackendTimeout  = 30 * time.Second
+	DefaultShutdownTimeout = 10 * time.Second
+	DefaultDrainDelay      = 10 * time.Second
+)
+
+// SourceInstance is a running source, with the config it was created from.
+// Cancelling its context stops it, done is closed once it has stopped, with
+// err set if it failed.
+type SourceInstance struct {
+	Key    string
+	Config *Source
+	Source sources.Source
+	cce    chan *shared.ChangeEvent
+	cancel context.CancelFunc
+	done   chan struct{}
+	err    error
+}
+
+// retry is a failed change event waiting to be applied again.
+type retry struct {
+	ce      *shared.ChangeEvent
+	attempt int
+	timer   *time.Timer
+}
+
+// drain is a route being drained, drained is set if the backend stopped
+// sending it new connections.
+type drain struct {
+	ce      *shared.ChangeEvent
+	drained bool
+	timer   *time.Timer
+}
+
 type Application struct {
 	Backend     backends.Backend
-	Sources     []sources.Source
+	Sources     map[string]*SourceInstance
+	Config      Config
+	Routes      RouteTable
+	Events      *hipdate.EventBroker
+	History     *hipdate.EventHistory
+	Health      *hipdate.Health
+	Drift       *hipdate.DriftDetector
+	Snapshot    *hipdate.RouteSnapshot
+	DeadLetters *hipdate.DeadLetterQueue
 	http        *hipdate.HttpServer
 	wg          *sync.WaitGroup
 	EventStream chan *shared.ChangeEvent
-	sc          chan bool
+	ctx         context.Context
+	done        chan struct{}
+	rc          chan bool
+	swc         chan []route
+	rtc         chan *retry
+	retries     map[route]*retry
+	dc          chan *drain
+	drains      map[route]*drain
+	pc          chan probeResult
+	probes      map[route]*probe
+	rejected    map[shared.Host]bool
+	seq         uint64
+	batch       *batcher
 }
 
 func NewApplication(
+	cfg Config,
 	b backends.Backend,
-	s []sources.Source,
-	cce chan *shared.ChangeEvent,
-	wg *sync.WaitGroup,
-	sc chan bool,
+	rc chan bool,
 ) *Application {
-	return &Application{
-		Backend:     b,
-		Sources:     s,
-		EventStream: cce,
-		wg:          wg,
-		sc:          sc,
+	a := &Application{
+		Sources:     map[string]*SourceInstance{},
+		Config:      cfg,
+		Routes:      RouteTable{},
+		Events:      hipdate.NewEventBroker(),
+		History:     hipdate.NewEventHistory(historySize(cfg.Options)),
+		Health:      hipdate.NewHealth(),
+		Drift:       hipdate.NewDriftDetector(),
+		Snapshot:    hipdate.NewRouteSnapshot(),
+		DeadLetters: hipdate.NewDeadLetterQueue(intOption(cfg.Options, "deadletter_size", hipdate.DefaultDeadLetterSize)),
+		EventStream: make(chan *shared.ChangeEvent),
+		wg:          &sync.WaitGroup{},
+		ctx:         context.Background(),
+		done:        make(chan struct{}),
+		rc:          rc,
+		swc:         make(chan []route),
+		rtc:         make(chan *retry),
+		retries:     map[route]*retry{},
+		dc:          make(chan *drain),
+		drains:      map[route]*drain{},
+		pc:          make(chan probeResult),
+		probes:      map[route]*probe{},
+	}
+	a.useBackend(b)
+
+	return a
+}
+
+// useBackend makes be the active backend, backends implementing
+// backends.Applier get their changes through a batcher.
+func (a *Application) useBackend(be backends.Backend) {
+	if a.batch != nil {
+		a.batch.stop()
+		a.batch = nil
+	}
+
+	if ap, ok := be.(backends.Applier); ok {
+		a.batch = newBatcher(
+			be,
+			ap,
+			durationOption(a.Config.Options, "apply_delay", DefaultApplyDelay),
+			durationOption(a.Config.Options, "apply_max_delay", DefaultApplyMaxDelay),
+		)
+		be = a.batch
+	}
+
+	a.Backend = be
+	a.rejected = map[shared.Host]bool{}
+}
+
+// rawBackend returns the active backend without the batcher.
+func (a *Application) rawBackend() backends.Backend {
+	if a.batch != nil {
+		return a.batch.Backend
 	}
+
+	return a.Backend
 }
 
-func (a *Application) EventListener() {
+// EventListener applies the events and handles the timers until ctx is done,
+// then shuts down.
+func (a *Application) EventListener(ctx context.Context) {
+	st := time.NewTicker(time.Second)
+	defer st.Stop()
+
+	bt := time.NewTicker(durationOption(a.Config.Options, "health_interval", DefaultHealthInterval))
+	defer bt.Stop()
+
+	dt := time.NewTicker(durationOption(a.Config.Options, "drift_interval", DefaultDriftInterval))
+	defer dt.Stop()
+
 	for {
 		select {
 		case ce := <-a.EventStream:
-			log.Printf("DEBUG Event received %v\n", ce)
-			h, ep := ce.Host, ce.Endpoint
-
-			switch ce.Type {
-			case "add":
-				if err := a.Backend.AddEndpoint(h, ep); err != nil {
-					log.Println("ERROR Failed to add upstream", err)
-				}
-				break
-			case "remove":
-				if err := a.Backend.RemoveEndpoint(h, ep); err != nil {
-					log.Println("ERROR Failed to remove upstream", err)
-				}
-				break
-			}
-		case <-a.sc:
-			a.http.Stop()
+			a.receive(ce)
+			a.routesChanged()
+		case r := <-a.rtc:
+			a.runRetry(r)
+			a.routesChanged()
+		case d := <-a.dc:
+			a.finishDrain(d)
+			a.routesChanged()
+		case r := <-a.pc:
+			a.probed(r)
+			a.routesChanged()
+		case dls := <-a.DeadLetters.Replays():
+			a.replay(dls)
+			a.routesChanged()
+		case <-a.rc:
+			a.Reload()
+			a.routesChanged()
+		case rs := <-a.swc:
+			a.sweep(rs)
+			a.routesChanged()
+		case <-st.C:
+			a.Health.Beat()
+			a.checkSources()
+		case <-bt.C:
+			a.observe("list", func(ctx context.Context) error {
+				_, err := a.Backend.ListHosts(ctx)
+				return err
+			})
+		case <-dt.C:
+			a.checkDrift()
+			a.routesChanged()
+		case <-a.batch.Flushes():
+			a.flush()
+		case <-ctx.Done():
+			a.shutdown()
 			return
 		}
 	}
 }
 
-func (a *Application) startEventListener() {
+// shutdown stops the sources and waits for them, applies the queued changes,
+// then closes the backend and stops the HTTP server. Waiting and backend
+// operations give up once shutdown_timeout has passed.
+func (a *Application) shutdown() {
+	close(a.done)
+	for _, r := range a.retries {
+		r.timer.Stop()
+	}
+	for _, d := range a.drains {
+		d.timer.Stop()
+	}
+	for _, p := range a.probes {
+		p.cancel()
+	}
+
+	ctx, cancel := context.WithTimeout(
+		context.Background(),
+		durationOption(a.Config.Options, "shutdown_timeout", DefaultShutdownTimeout),
+	)
+	defer cancel()
+	a.ctx = ctx
+
+	for _, si := range a.Sources {
+		si.cancel()
+	}
+
+	for k, si := range a.Sources {
+		select {
+		case <-si.done:
+		case <-ctx.Done():
+			log.Printf("WARN [source:%s] Didn't stop in time", k)
+		}
+	}
+
+	if a.batch != nil {
+		a.flush()
+		a.batch.stop()
+	}
+
+	if c, ok := a.rawBackend().(io.Closer); ok {
+		c.Close()
+	}
+
+	a.http.Stop()
+}
+
+// receive numbers and applies an event, the events of a batch are applied in
+// order without any other events in between.
+func (a *Application) receive(ce *shared.ChangeEvent) {
+	a.seq++
+	ce.Seq = a.seq
+	metrics.EventsReceived.Inc(ce.Source, ce.Type.String())
+
+	if ce.Type == shared.EventBatch {
+		log.Printf("DEBUG Batch %d of %d events received from %s\n", ce.Seq, len(ce.Events), ce.Source)
+		for _, sce := range ce.Events {
+			a.receive(sce)
+		}
+		return
+	}
+
+	log.Printf("DEBUG Event received %v\n", ce)
+	a.cancelRetry(ce)
+	a.dropDeadLetters(ce)
+	if ce.Type != shared.EventDrain && a.cancelDrain(ce) && ce.Type == shared.EventAdd {
+		a.undrain(ce)
+	}
+
+	res, err := a.handleEvent(ce)
+	a.settle(ce, res, err, 0)
+
+	// A failed drain isn't retried, the route is removed after the delay anyway
+	if err != nil && ce.Type != shared.EventDrain {
+		a.scheduleRetry(ce, 1, err)
+	}
+}
+
+// handleEvent applies a change event, and returns whether the backend was
+// changed, skipped because the route table made it a no-op or the backend
+// can't route it, held back until the endpoint passes its health check, or
+// failed.
+func (a *Application) handleEvent(ce *shared.ChangeEvent) (string, error) {
+	h, ep := ce.Host, ce.Endpoint
+
+	switch ce.Type {
+	case shared.EventAdd:
+		if a.rejects(h) {
+			a.Routes.Own(h, ep, ce.Source)
+			return hipdate.ResultSkipped, nil
+		}
+
+		if a.Routes.Applied(h, ep) {
+			a.Routes.Own(h, ep, ce.Source)
+			a.watch(h, ep, true)
+			return hipdate.ResultSkipped, nil
+		}
+
+		if ep.Check.Enabled() {
+			a.Routes.Own(h, ep, ce.Source)
+			a.watch(h, ep, false)
+			return hipdate.ResultHeld, nil
+		}
+
+		err := a.observe("add", func(ctx context.Context) error {
+			return a.Backend.AddEndpoint(ctx, h, ep)
+		})
+		if err != nil {
+			log.Println("ERROR Failed to add upstream", err)
+			return hipdate.ResultFailed, err
+		}
+		a.Routes.Own(h, ep, ce.Source)
+	case shared.EventRemove:
+		if !a.Routes.Disown(h, ep, ce.Source) {
+			return hipdate.ResultSkipped, nil
+		}
+
+		if err := a.removeRoute(h, ep); err != nil {
+			return hipdate.ResultFailed, err
+		}
+	case shared.EventDrain:
+		return a.drainRoute(ce)
+	default:
+		log.Printf("WARN Ignoring %s event %d from %s", ce.Type, ce.Seq, ce.Source)
+		return hipdate.ResultSkipped, nil
+	}
+
+	return hipdate.ResultApplied, nil
+}
+
+// drainRoute has the backend stop sending new connections to a route if it
+// supports that, and removes the route after drain_delay, unless its source
+// removes or adds it again first. Only the sole owner of a route can drain it.
+func (a *Application) drainRoute(ce *shared.ChangeEvent) (string, error) {
+	h, ep := ce.Host, ce.Endpoint
+	k := route{h, ep.Bare()}
+	if !a.Routes.SoleOwner(h, ep, ce.Source) || a.drains[k] != nil {
+		return hipdate.ResultSkipped, nil
+	}
+
+	d := &drain{ce: ce}
+	d.timer = time.AfterFunc(durationOption(a.Config.Options, "drain_delay", DefaultDrainDelay), func() {
+		select {
+		case a.dc <- d:
+		case <-a.done:
+		}
+	})
+	a.drains[k] = d
+
+	// Routes failing their health check aren't in the backend to drain
+	if !a.healthy(k) || a.rejects(h) {
+		d.drained = true
+		return hipdate.ResultApplied, nil
+	}
+
+	dr, ok := a.rawBackend().(backends.Drainer)
+	if !ok {
+		return hipdate.ResultApplied, nil
+	}
+
+	if a.batch != nil {
+		a.flush()
+	}
+
+	err := a.observe("drain", func(ctx context.Context) error {
+		return dr.DrainEndpoint(ctx, h, ep)
+	})
+	if err != nil {
+		log.Println("ERROR Failed to drain upstream", err)
+		return hipdate.ResultFailed, err
+	}
+	d.drained = true
+
+	return hipdate.ResultApplied, nil
+}
+
+// cancelDrain stops draining the route of ce, returning whether the backend
+// had it drained.
+func (a *Application) cancelDrain(ce *shared.ChangeEvent) bool {
+	k := route{ce.Host, ce.Endpoint.Bare()}
+	d, ok := a.drains[k]
+	if !ok {
+		return false
+	}
+
+	d.timer.Stop()
+	delete(a.drains, k)
+
+	return d.drained
+}
+
+// undrain adds a drained route to the backend again, its source added it back
+// before the drain finished.
+func (a *Application) undrain(ce *shared.ChangeEvent) {
+	if !a.healthy(route{ce.Host, ce.Endpoint.Bare()}) {
+		return
+	}
+
+	err := a.observe("add", func(ctx context.Context) error {
+		return a.Backend.AddEndpoint(ctx, ce.Host, ce.Endpoint)
+	})
+	if err != nil {
+		log.Println("ERROR Failed to add drained upstream again", err)
+	}
+}
+
+// finishDrain removes a route once it has been drained for drain_delay.
+func (a *Application) finishDrain(d *drain) {
+	k := route{d.ce.Host, d.ce.Endpoint.Bare()}
+	if a.drains[k] != d {
+		return
+	}
+
+	ce := shared.NewChangeEvent(shared.EventRemove, d.ce.Host, d.ce.Endpoint)
+	ce.Source = d.ce.Source
+	a.receive(ce)
+}
+
+// retryEvent applies a change event again after it failed, the route table
+// was already updated when it was first handled, so only the backend
+// operation is repeated, unless the route changed in the meantime.
+func (a *Application) retryEvent(ce *shared.ChangeEvent) (string, error) {
+	h, ep := ce.Host, ce.Endpoint
+	metrics.BackendRetries.Inc(a.Config.Backend.Name, ce.Type.String())
+
+	switch ce.Type {
+	case shared.EventAdd:
+		if a.Routes.Applied(h, ep) || a.rejects(h) {
+			a.Routes.Own(h, ep, ce.Source)
+			return hipdate.ResultSkipped, nil
+		}
+
+		err := a.observe("add", func(ctx context.Context) error {
+			return a.Backend.AddEndpoint(ctx, h, ep)
+		})
+		if err != nil {
+			log.Println("ERROR Failed to add upstream", err)
+			return hipdate.ResultFailed, err
+		}
+		a.Routes.Own(h, ep, ce.Source)
+	case shared.EventRemove:
+		if a.Routes.Applied(h, ep) || a.rejects(h) {
+			return hipdate.ResultSkipped, nil
+		}
+
+		err := a.observe("remove", func(ctx context.Context) error {
+			return a.Backend.RemoveEndpoint(ctx, h, ep)
+		})
+		if err != nil {
+			log.Println("ERROR Failed to remove upstream", err)
+			return hipdate.ResultFailed, err
+		}
+	default:
+		return hipdate.ResultSkipped, nil
+	}
+
+	return hipdate.ResultApplied, nil
+}
+
+// scheduleRetry retries a failed event after an exponential backoff, once
+// retry_max retries have failed the event goes to the dead letter queue.
+func (a *Application) scheduleRetry(ce *shared.ChangeEvent, attempts int, err error) {
+	k := route{ce.Host, ce.Endpoint.Bare()}
+	delete(a.retries, k)
+
+	if attempts > intOption(a.Config.Options, "retry_max", DefaultRetryMax) {
+		dl := a.DeadLetters.Add(ce, attempts, err)
+		metrics.DeadLetters.Set(float64(a.DeadLetters.Len()))
+		log.Printf("ERROR Giving up on %s %s %s after %d attempts, dead letter %d",
+			ce.Type, ce.Host, ce.Endpoint.String(), attempts, dl.Id)
+		return
+	}
+
+	d := retryBackoff(
+		attempts,
+		durationOption(a.Config.Options, "retry_backoff", DefaultRetryBackoff),
+		durationOption(a.Config.Options, "retry_max_backoff", DefaultRetryMaxDelay),
+	)
+	log.Printf("WARN Retrying %s %s %s in %s", ce.Type, ce.Host, ce.Endpoint.String(), d)
+
+	r := &retry{ce: ce, attempt: attempts}
+	r.timer = time.AfterFunc(d, func() {
+		select {
+		case a.rtc <- r:
+		case <-a.done:
+		}
+	})
+	a.retries[k] = r
+}
+
+// cancelRetry drops the pending retry for the route of ce, newer events for
+// a route supersede the failed ones.
+func (a *Application) cancelRetry(ce *shared.ChangeEvent) {
+	k := route{ce.Host, ce.Endpoint.Bare()}
+	if r, ok := a.retries[k]; ok {
+		r.timer.Stop()
+		delete(a.retries, k)
+	}
+}
+
+// dropDeadLetters drops the dead letters for the route of ce, replaying them
+// would undo ce.
+func (a *Application) dropDeadLetters(ce *shared.ChangeEvent) {
+	if n := a.DeadLetters.Drop(ce.Host, ce.Endpoint); n > 0 {
+		metrics.DeadLetters.Set(float64(a.DeadLetters.Len()))
+		log.Printf("NOTICE Dropped %d dead letters for %s %s, superseded by event %d",
+			n, ce.Host, ce.Endpoint.String(), ce.Seq)
+	}
+}
+
+func (a *Application) runRetry(r *retry) {
+	k := route{r.ce.Host, r.ce.Endpoint.Bare()}
+	if a.retries[k] != r {
+		return
+	}
+	delete(a.retries, k)
+
+	res, err := a.retryEvent(r.ce)
+	a.settle(r.ce, res, err, r.attempt+1)
+	if err != nil {
+		a.scheduleRetry(r.ce, r.attempt+1, err)
+	}
+}
+
+// replay applies dead letters again, they get a fresh set of retries.
+func (a *Application) replay(dls []*hipdate.DeadLetter) {
+	metrics.DeadLetters.Set(float64(a.DeadLetters.Len()))
+
+	for _, dl := range dls {
+		log.Printf("NOTICE Replaying dead letter %d", dl.Id)
+		a.cancelRetry(dl.Event)
+
+		res, err := a.retryEvent(dl.Event)
+		a.settle(dl.Event, res, err, dl.Attempts+1)
+		if err != nil {
+			a.scheduleRetry(dl.Event, 1, err)
+		}
+	}
+}
+
+// settle records the outcome of an event, unless its change was queued by the
+// batcher, then that's recorded once the change is applied.
+func (a *Application) settle(ce *shared.ChangeEvent, res string, err error, attempt int) {
+	if res == hipdate.ResultApplied && a.batch != nil && a.batch.track(ce, attempt) {
+		return
+	}
+
+	a.record(ce, res, err, attempt)
+}
+
+func (a *Application) record(ce *shared.ChangeEvent, res string, err error, attempt int) {
+	r := hipdate.NewEventRecord(ce, res, err)
+	r.Attempt = attempt
+	a.Events.Publish(r)
+	a.History.Add(r)
+}
+
+// retryBackoff returns the delay before the given attempt, doubling from base
+// up to max.
+func retryBackoff(attempt int, base, max time.Duration) time.Duration {
+	d := base
+	for i := 1; i < attempt && d < max; i++ {
+		d *= 2
+	}
+
+	if d > max {
+		return max
+	}
+
+	return d
+}
+
+// flush applies the changes queued by the batcher, and records the outcome of
+// their events. Changes that fail are tried again after a backoff, once
+// retry_max retries have failed their events go to the dead letter queue.
+func (a *Application) flush() {
+	qs := a.batch.take()
+	if len(qs) == 0 {
+		return
+	}
+
+	cs := make([]backends.Change, len(qs))
+	for i, q := range qs {
+		cs[i] = q.Change
+	}
+
+	err := a.observe("apply", func(ctx context.Context) error {
+		return a.batch.ap.Apply(ctx, cs)
+	})
+	if err == nil {
+		log.Printf("DEBUG Applied %d changes", len(cs))
+		a.batch.failures = 0
+		for _, q := range qs {
+			a.recordQueued(q, hipdate.ResultApplied, nil)
+		}
+		return
+	}
+
+	retries := []*queued{}
+	for _, q := range qs {
+		a.recordQueued(q, hipdate.ResultFailed, err)
+		q.failures++
+		if q.failures > intOption(a.Config.Options, "retry_max", DefaultRetryMax) {
+			a.giveUp(q, err)
+			continue
+		}
+		retries = append(retries, q)
+	}
+
+	if len(retries) == 0 {
+		a.batch.failures = 0
+		return
+	}
+
+	a.batch.failures++
+	d := retryBackoff(
+		a.batch.failures,
+		durationOption(a.Config.Options, "retry_backoff", DefaultRetryBackoff),
+		durationOption(a.Config.Options, "retry_max_backoff", DefaultRetryMaxDelay),
+	)
+	log.Printf("ERROR Failed to apply %d changes, retrying in %s: %s", len(retries), d, err)
+	metrics.BackendRetries.Inc(a.Config.Backend.Name, "apply")
+	a.batch.requeue(retries, d)
+}
+
+// recordQueued records the outcome of applying a queued change for its
+// events. Events superseded by a change of another type are recorded as
+// skipped and dropped.
+func (a *Application) recordQueued(q *queued, res string, err error) {
+	kept := []tracked{}
+	for _, t := range q.events {
+		if t.ce.Type != q.Type {
+			a.record(t.ce, hipdate.ResultSkipped, nil, t.attempt)
+			continue
+		}
+
+		a.record(t.ce, res, err, t.attempt+q.failures)
+		kept = append(kept, t)
+	}
+	q.events = kept
+}
+
+// giveUp drops a queued change that kept failing, and sends its events to the
+// dead letter queue. The route table is reverted for added routes, so
+// replaying them adds them again. Changes without events, like the ones made
+// for health checks, are left to drift repair.
+func (a *Application) giveUp(q *queued, err error) {
+	if len(q.events) == 0 {
+		log.Printf("ERROR Giving up on %s %s %s after %d attempts",
+			q.Type, q.Host, q.Endpoint.String(), q.failures)
+		return
+	}
+
+	for _, t := range q.events {
+		if q.Type == shared.EventAdd && a.Routes.Disown(q.Host, q.Endpoint, t.ce.Source) {
+			a.Routes.Delete(q.Host, q.Endpoint)
+		}
+
+		attempts := t.attempt + q.failures
+		dl := a.DeadLetters.Add(t.ce, attempts, err)
+		log.Printf("ERROR Giving up on %s %s %s after %d attempts, dead letter %d",
+			t.ce.Type, t.ce.Host, t.ce.Endpoint.String(), attempts, dl.Id)
+	}
+	metrics.DeadLetters.Set(float64(a.DeadLetters.Len()))
+}
+
+// removeRoute deletes a route, removing it from the backend unless its health
+// check kept it out.
+func (a *Application) removeRoute(h shared.Host, ep shared.Endpoint) error {
+	if !a.unwatch(route{h, ep.Bare()}) || a.rejects(h) {
+		a.Routes.Delete(h, ep)
+		return nil
+	}
+
+	err := a.observe("remove", func(ctx context.Context) error {
+		return a.Backend.RemoveEndpoint(ctx, h, ep)
+	})
+	if err != nil {
+		log.Println("ERROR Failed to remove upstream", err)
+	}
+	a.Routes.Delete(h, ep)
+
+	return err
+}
+
+// opContext returns the context for a backend operation, which gives up after
+// backend_timeout.
+func (a *Application) opContext() (context.Context, context.CancelFunc) {
+	return context.WithTimeout(a.ctx, durationOption(a.Config.Options, "backend_timeout", DefaultBackendTimeout))
+}
+
+// observe runs a backend operation, recording its outcome and latency.
+func (a *Application) observe(op string, fn func(ctx context.Context) error) error {
+	ctx, cancel := a.opContext()
+	defer cancel()
+
+	// Queued changes are observed once they're applied
+	if a.batch != nil && (op == "add" || op == "remove") {
+		return fn(ctx)
+	}
+
+	be := a.Config.Backend.Name
+	start := time.Now()
+	err := fn(ctx)
+
+	metrics.BackendLatency.Observe(time.Since(start), be, op)
+	metrics.BackendOperations.Inc(be, op)
+	if err != nil {
+		metrics.BackendErrors.Inc(be, op)
+	} else if op == "add" || op == "remove" || op == "apply" || op == "drain" {
+		metrics.LastChange.Set(float64(time.Now().Unix()))
+	}
+
+	if a.Health.Set("backend", err == nil, err) {
+		if err != nil {
+			log.Printf("WARN [backend:%s] Not ready: %s", be, err)
+		} else {
+			log.Printf("NOTICE [backend:%s] Ready", be)
+		}
+	}
+
+	return err
+}
+
+// checkDrift compares the routes in the route table with the ones in the
+// backend, and repairs the differences if drift_repair is enabled.
+func (a *Application) checkDrift() {
+	if a.batch != nil {
+		a.flush()
+	}
+
+	var actual *shared.HostList
+	err := a.observe("list", func(ctx context.Context) (err error) {
+		actual, err = a.Backend.ListHosts(ctx)
+		return err
+	})
+	if err != nil {
+		log.Println("ERROR [drift] Failed to list hosts:", err)
+		a.Drift.Set(&hipdate.DriftReport{Time: time.Now(), Error: err.Error()})
+		return
+	}
+
+	dr := hipdate.ComputeDrift(a.expectedRoutes(), *actual)
+	m, u := dr.Count()
+	metrics.Drift.Set(float64(m), "missing")
+	metrics.Drift.Set(float64(u), "unexpected")
+
+	if !dr.InSync() {
+		log.Printf("WARN [drift] %d endpoints missing from and %d unexpected in the backend", m, u)
+		if a.Config.Options["drift_repair"] == "true" {
+			a.repairDrift(dr)
+			dr.Repaired = true
+		}
+	}
+
+	a.Drift.Set(dr)
+}
+
+// expectedRoutes returns the routes that should be in the backend, which
+// doesn't have the drained ones, nor the ones failing their health check.
+func (a *Application) expectedRoutes() shared.HostList {
+	return a.routesFor(a.rawBackend())
+}
+
+// routesFor returns the routes that should be in the backend be, leaving out
+// the ones it can't route.
+func (a *Application) routesFor(be backends.Backend) shared.HostList {
+	hl := a.Routes.HostList()
+	for h, eps := range hl {
+		if rc, ok := be.(backends.RouteChecker); ok && rc.CheckRoute(h) != nil {
+			delete(hl, h)
+			continue
+		}
+
+		kept := []shared.Endpoint{}
+		for _, ep := range eps {
+			k := route{h, ep.Bare()}
+			if d := a.drains[k]; (d == nil || !d.drained) && a.healthy(k) {
+				kept = append(kept, ep)
+			}
+		}
+		hl[h] = kept
+	}
+
+	return hl
+}
+
+func (a *Application) repairDrift(dr *hipdate.DriftReport) {
+	for h, eps := range dr.Missing {
+		for _, ep := range eps {
+			log.Println("NOTICE [drift] Re-adding", h, ep.String())
+			a.observe("add", func(ctx context.Context) error {
+				return a.Backend.AddEndpoint(ctx, h, ep)
+			})
+		}
+	}
+
+	for h, eps := range dr.Unexpected {
+		for _, ep := range eps {
+			log.Println("NOTICE [drift] Removing", h, ep.String())
+			a.observe("remove", func(ctx context.Context) error {
+				return a.Backend.RemoveEndpoint(ctx, h, ep)
+			})
+		}
+	}
+}
+
+// rejects returns whether the backend can't route h, logging why the first
+// time.
+func (a *Application) rejects(h shared.Host) bool {
+	rc, ok := a.rawBackend().(backends.RouteChecker)
+	if !ok {
+		return false
+	}
+
+	err := rc.CheckRoute(h)
+	if err != nil && !a.rejected[h] {
+		log.Printf("WARN [backend:%s] Not routing %s: %s", a.Config.Backend.Name, h, err)
+		a.rejected[h] = true
+	}
+
+	return err != nil
+}
+
+// checkSources updates the health of the sources from the status they report.
+func (a *Application) checkSources() {
+	for k, si := range a.Sources {
+		st := sources.Status{Synced: true}
+		if sr, ok := si.Source.(sources.StatusReporter); ok {
+			st = sr.Status()
+		}
+
+		select {
+		case <-si.done:
+			if si.err != nil {
+				st = sources.Status{Err: si.err}
+			}
+		default:
+		}
+
+		if !a.Health.Set("source:"+k, st.Synced, st.Err) {
+			continue
+		}
+
+		switch {
+		case st.Err != nil:
+			log.Printf("WARN [source:%s] Not ready: %s", k, st.Err)
+		case st.Synced:
+			log.Printf("NOTICE [source:%s] Ready", k)
+		}
+	}
+}
+
+// routesChanged publishes the routes for the API and updates the metrics.
+func (a *Application) routesChanged() {
+	a.Snapshot.Set(a.Routes.HostList())
+
+	n := 0
+	for _, eps := range a.Routes {
+		n += len(eps)
+	}
+
+	u := 0
+	for _, p := range a.probes {
+		if !p.up {
+			u++
+		}
+	}
+
+	metrics.Hosts.Set(float64(len(a.Routes)))
+	metrics.Endpoints.Set(float64(n))
+	metrics.UnhealthyEndpoints.Set(float64(u))
+}
+
+// StartSources initialises and starts the configured sources, returning the
+// number of sources that were started.
+func (a *Application) StartSources() int {
+	for k, s := range SourceKeys(a.Config.Sources) {
+		a.startSource(k, s)
+	}
+
+	return len(a.Sources)
+}
+
+func (a *Application) startSource(k string, s *Source) {
+	si := &SourceInstance{
+		Key:    k,
+		Config: s,
+		cce:    make(chan *shared.ChangeEvent),
+		done:   make(chan struct{}),
+	}
+
+	src, err := InitSource(s, si.cce)
+	if err != nil {
+		log.Printf("ERROR [source:%s] %s", k, err)
+		return
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	si.Source = src
+	si.cancel = cancel
+	a.Sources[k] = si
+	a.Health.Set("source:"+k, false, nil)
+
+	go a.forward(ctx, si)
+	go func() {
+		defer close(si.done)
+
+		if err := si.Source.Start(ctx); err != nil {
+			log.Printf("ERROR [source:%s] %s", k, err)
+			si.err = err
+		}
+		close(si.cce)
+	}()
+}
+
+// stopSource stops a running source, its routes are withdrawn right away when
+// withdraw is set, otherwise they're kept until the reload grace period has
+// passed, giving its replacement the chance to claim them.
+func (a *Application) stopSource(k string, withdraw bool) {
+	si, ok := a.Sources[k]
+	if !ok {
+		return
+	}
+
+	si.cancel()
+	delete(a.Sources, k)
+	a.Health.Remove("source:" + k)
+
+	rs := a.Routes.Owned(k)
+	for _, r := range rs {
+		a.Routes.Disown(r.Host, r.Endpoint, k)
+	}
+
+	if withdraw {
+		a.sweep(rs)
+		return
+	}
+
+	time.AfterFunc(a.reloadGrace(), func() {
+		select {
+		case a.swc <- rs:
+		case <-a.done:
+		}
+	})
+}
+
+// sweep removes the given routes if no source claimed them in the meantime.
+func (a *Application) sweep(rs []route) {
+	for _, r := range rs {
+		if a.Routes.Orphaned(r.Host, r.Endpoint) {
+			a.removeRoute(r.Host, r.Endpoint)
+		}
+	}
+}
+
+// forward tags the events of a source with its key, dropping the ones that
+// arrive after it was told to stop. It keeps draining them until the source
+// has stopped, so the source never blocks on sending.
+func (a *Application) forward(ctx context.Context, si *SourceInstance) {
+	for ce := range si.cce {
+		if ctx.Err() != nil {
+			continue
+		}
+
+		tagEvent(ce, si.Key)
+		select {
+		case a.EventStream <- ce:
+		case <-ctx.Done():
+		}
+	}
+}
+
+func tagEvent(ce *shared.ChangeEvent, src string) {
+	ce.Source = src
+	ce.Endpoint.Origin.Source = src
+	for _, sce := range ce.Events {
+		tagEvent(sce, src)
+	}
+}
+
+func (a *Application) reloadGrace() time.Duration {
+	return durationOption(a.Config.Options, "reload_grace", DefaultReloadGrace)
+}
+
+func durationOption(opts shared.OptionMap, k string, def time.Duration) time.Duration {
+	v, ok := opts[k]
+	if !ok {
+		return def
+	}
+
+	d, err := time.ParseDuration(v)
+	if err != nil || d <= 0 {
+		log.Printf("WARN Invalid %s '%s', using %s", k, v, def)
+		return def
+	}
+
+	return d
+}
+
+func intOption(opts shared.OptionMap, k string, def int) int {
+	v, ok := opts[k]
+	if !ok {
+		return def
+	}
+
+	n, err := strconv.Atoi(v)
+	if err != nil || n < 0 {
+		log.Printf("WARN Invalid %s '%s', using %d", k, v, def)
+		return def
+	}
+
+	return n
+}
+
+func historySize(opts shared.OptionMap) int {
+	v, ok := opts["history_size"]
+	if !ok {
+		return hipdate.DefaultHistorySize
+	}
+
+	n, err := strconv.Atoi(v)
+	if err != nil || n < 1 {
+		log.Printf("WARN Invalid history_size '%s', using %d", v, hipdate.DefaultHistorySize)
+		return hipdate.DefaultHistorySize
+	}
+
+	return n
+}
+
+// Reload reloads the config, starting and stopping the sources that were
+// added or removed, and restarting the ones that changed. Routes are kept
+// applied throughout, and the backend is only replaced if its definition
+// changed.
+func (a *Application) Reload() {
+	cfg, err := LoadConfig()
+	if err != nil {
+		log.Printf("ERROR Failed to load %s, keeping current config: %s\n", *cfgFile, err)
+		return
+	}
+
+	if cfg.Backend == nil {
+		log.Println("ERROR No backend selected, keeping current config")
+		return
+	}
+
+	warnRestart(a.Config.Options, cfg.Options)
+
+	if !cfg.Backend.Equal(a.Config.Backend) {
+		if err := a.swapBackend(cfg); err != nil {
+			log.Printf("ERROR [backend:%s] %s, keeping current backend", cfg.Backend.Name, err)
+			cfg.Backend = a.Config.Backend
+		}
+	}
+
+	running := map[string]*Source{}
+	for k, si := range a.Sources {
+		running[k] = si.Config
+	}
+
+	keys := SourceKeys(cfg.Sources)
+	added, removed, changed := DiffSources(running, keys)
+
+	for _, k := range removed {
+		log.Printf("NOTICE [source:%s] Removed", k)
+		a.stopSource(k, true)
+	}
+
+	for _, k := range changed {
+		log.Printf("NOTICE [source:%s] Changed", k)
+		si := a.Sources[k]
+		if rl, ok := si.Source.(sources.Reloader); ok {
+			if err := rl.Reload(keys[k].Options); err != nil {
+				log.Printf("ERROR [source:%s] %s", k, err)
+				continue
+			}
+			si.Config = keys[k]
+			continue
+		}
+
+		a.stopSource(k, false)
+		a.startSource(k, keys[k])
+	}
+
+	for _, k := range added {
+		log.Printf("NOTICE [source:%s] Added", k)
+		a.startSource(k, keys[k])
+	}
+
+	a.Config = cfg
+	log.Println("NOTICE Config reloaded")
+}
+
+// restartOptions are the options, or prefixes of them, that are only read
+// on startup.
+var restartOptions = []string{"http_", "history_size", "deadletter_size"}
+
+// warnRestart logs the options a reload changed that only take effect after a
+// restart.
+func warnRestart(old, new shared.OptionMap) {
+	keys := map[string]bool{}
+	for k := range old {
+		keys[k] = true
+	}
+	for k := range new {
+		keys[k] = true
+	}
+
+	for k := range keys {
+		for _, p := range restartOptions {
+			if strings.HasPrefix(k, p) && old[k] != new[k] {
+				log.Printf("WARN Option %s changed, restart to apply it", k)
+			}
+		}
+	}
+}
+
+// swapBackend applies the current routes to the backend from cfg and makes it
+// the active backend. The backend isn't initialised, which would clear it,
+// instead the routes it has are reconciled so a backend that only had its
+// options changed keeps serving them meanwhile.
+func (a *Application) swapBackend(cfg Config) error {
+	log.Printf("NOTICE [backend:%s] Replacing backend", cfg.Backend.Name)
+
+	be, err := InitBackend(cfg)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := a.opContext()
+	defer cancel()
+
+	actual, err := be.ListHosts(ctx)
+	if err != nil {
+		return err
+	}
+
+	// Every route is added again, which updates the metadata of the ones the
+	// backend already has
+	expected, cs := a.routesFor(be), []backends.Change{}
+	for h, eps := range expected {
+		for _, ep := range eps {
+			cs = append(cs, backends.Change{Type: shared.EventAdd, Host: h, Endpoint: ep})
+		}
+	}
+
+	for h, eps := range hipdate.ComputeDrift(expected, *actual).Unexpected {
+		for _, ep := range eps {
+			cs = append(cs, backends.Change{Type: shared.EventRemove, Host: h, Endpoint: ep})
+		}
+	}
+
+	if ap, ok := be.(backends.Applier); ok {
+		if err := ap.Apply(ctx, cs); err != nil {
+			log.Println("ERROR Failed to apply upstreams", err)
+		}
+	} else {
+		for _, c := range cs {
+			var err error
+			if c.Type == shared.EventAdd {
+				err = be.AddEndpoint(ctx, c.Host, c.Endpoint)
+			} else {
+				err = be.RemoveEndpoint(ctx, c.Host, c.Endpoint)
+			}
+			if err != nil {
+				log.Printf("ERROR Failed to %s upstream %s %s: %s", c.Type, c.Host, c.Endpoint.String(), err)
+			}
+		}
+	}
+
+	old := a.rawBackend()
+	a.useBackend(be)
+	a.http.SetBackend(be)
+
+	if c, ok := old.(io.Closer); ok {
+		c.Close()
+	}
+
+	return nil
+}
+
+func (a *Application) startEventListener(ctx context.Context) {
 	defer a.wg.Done()
 
-	a.EventListener()
+	a.EventListener(ctx)
 	log.Println("NOTICE [app] stopped")
 }
 
-func (a *Application) startHttpServer() error {
+func (a *Application) startHttpServer() {
 	defer a.wg.Done()
 
-	a.http = hipdate.NewHttpServer(a.Backend)
-	return a.http.Start()
+	a.http.Serve()
 }
 
-func (a *Application) Start() {
-	log.Println("NOTICE Starting main event listener")
-	a.wg.Add(1)
-	go a.startEventListener()
-
-	log.Printf("NOTICE Initialising backend")
-	err := a.Backend.Initialise()
+// Start initialises the backend and runs the application until ctx is done,
+// returning once it has shut down.
+func (a *Application) Start(ctx context.Context) error {
+	hs, err := hipdate.NewHttpServer(a.rawBackend(), a.Config.Options)
 	if err != nil {
-		log.Panic("PANIC Backend error:", err)
+		log.Println("ERROR HTTP server error:", err)
+		return err
 	}
+	a.http = hs
+	a.http.Events = a.Events
+	a.http.History = a.History
+	a.http.Health = a.Health
+	a.http.Drift = a.Drift
+	a.http.DeadLetters = a.DeadLetters
+	a.http.Routes = a.Snapshot
+
+	a.Health.Set("backend", false, nil)
 
-	log.Printf("NOTICE Starting sources")
-	for _, s := range a.Sources {
-		go s.Start()
+	// Listening before anything runs, so shutdown can always stop the server
+	if err := a.http.Listen(); err != nil {
+		log.Println("ERROR [http]", err)
+		return err
 	}
 
+	log.Printf("NOTICE Initialising backend")
+	if err := a.observe("initialise", a.Backend.Initialise); err != nil {
+		log.Println("ERROR Backend error:", err)
+		a.http.Stop()
+		return err
+	}
+
+	log.Println("NOTICE Starting main event listener")
+	a.wg.Add(1)
+	go a.startEventListener(ctx)
+
 	log.Printf("NOTICE Starting HTTP server")
 	a.wg.Add(1)
 	go a.startHttpServer()
 
 	a.wg.Wait()
-	log.Println("NOTICE Stopping cleanly via EOF")
+	log.Println("NOTICE Stopped cleanly")
+	return nil
 }
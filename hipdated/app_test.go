@@ -0,0 +1,854 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/3onyc/hipdate"
+	"github.com/3onyc/hipdate/backends"
+	"github.com/3onyc/hipdate/shared"
+	"github.com/3onyc/hipdate/sources"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// fakeBackend records the operations applied to it.
+type fakeBackend struct {
+	ops []string
+}
+
+func (fb *fakeBackend) AddEndpoint(ctx context.Context, h shared.Host, e shared.Endpoint) error {
+	fb.ops = append(fb.ops, "add "+string(h)+" "+e.String())
+	return nil
+}
+
+func (fb *fakeBackend) RemoveEndpoint(ctx context.Context, h shared.Host, e shared.Endpoint) error {
+	fb.ops = append(fb.ops, "remove "+string(h)+" "+e.String())
+	return nil
+}
+
+func (fb *fakeBackend) ListHosts(ctx context.Context) (*shared.HostList, error) {
+	return &shared.HostList{}, nil
+}
+
+func (fb *fakeBackend) Initialise(ctx context.Context) error {
+	return nil
+}
+
+func newTestApplication(be *fakeBackend) *Application {
+	cfg := NewConfig()
+	cfg.Backend = NewBackend("fake", nil)
+
+	return NewApplication(cfg, be, make(chan bool))
+}
+
+func TestRetryBackoff(t *testing.T) {
+	expected := []time.Duration{
+		time.Second,
+		2 * time.Second,
+		4 * time.Second,
+		8 * time.Second,
+		10 * time.Second,
+		10 * time.Second,
+	}
+
+	for i, e := range expected {
+		if d := retryBackoff(i+1, time.Second, 10*time.Second); d != e {
+			t.Logf("Expected %s before attempt %d, got %s", e, i+1, d)
+			t.Fail()
+		}
+	}
+}
+
+func TestReceiveBatch(t *testing.T) {
+	be := &fakeBackend{}
+	a := newTestApplication(be)
+
+	e1 := *shared.NewEndpoint("http", "10.0.0.1", 80)
+	e2 := *shared.NewEndpoint("http", "10.0.0.2", 80)
+	ce := shared.NewBatchEvent([]*shared.ChangeEvent{
+		shared.NewChangeEvent(shared.EventAdd, "example.com", e1),
+		shared.NewChangeEvent(shared.EventAdd, "example.com", e2),
+		shared.NewChangeEvent(shared.EventRemove, "example.com", e1),
+	})
+	tagEvent(ce, "static")
+	a.receive(ce)
+
+	if len(be.ops) != 3 || be.ops[2] != "remove example.com http://10.0.0.1:80" {
+		t.Logf("Unexpected operations %v", be.ops)
+		t.Fail()
+	}
+
+	for i, sce := range ce.Events {
+		if sce.Seq != uint64(i+2) || sce.Source != "static" {
+			t.Logf("Unexpected seq %d and source '%s' for event %d", sce.Seq, sce.Source, i)
+			t.Fail()
+		}
+	}
+
+	if !a.Routes.Applied("example.com", e2) || a.Routes.Applied("example.com", e1) {
+		t.Logf("Unexpected routes %v", a.Routes)
+		t.Fail()
+	}
+}
+
+// fakeApplier is a backend applying changes in bulk, which fails while
+// failing is set.
+type fakeApplier struct {
+	fakeBackend
+	applied [][]backends.Change
+	failing bool
+}
+
+func (fa *fakeApplier) Apply(ctx context.Context, cs []backends.Change) error {
+	if fa.failing {
+		return unavailableError
+	}
+
+	fa.applied = append(fa.applied, cs)
+	return nil
+}
+
+func waitFlush(t *testing.T, a *Application) {
+	select {
+	case <-a.batch.Flushes():
+		a.flush()
+	case <-time.After(2 * time.Second):
+		t.Fatal("Changes weren't flushed")
+	}
+}
+
+func TestBatcherApply(t *testing.T) {
+	be := &fakeApplier{}
+	cfg := NewConfig()
+	cfg.Backend = NewBackend("fake", nil)
+	cfg.Options["apply_delay"] = "10ms"
+	a := NewApplication(cfg, be, make(chan bool))
+
+	e1 := *shared.NewEndpoint("http", "10.0.0.1", 80)
+	e2 := *shared.NewEndpoint("http", "10.0.0.2", 80)
+	for _, ce := range []*shared.ChangeEvent{
+		shared.NewChangeEvent(shared.EventAdd, "example.com", e1),
+		shared.NewChangeEvent(shared.EventAdd, "example.com", e2),
+		shared.NewChangeEvent(shared.EventRemove, "example.com", e1),
+	} {
+		ce.Source = "static"
+		a.receive(ce)
+	}
+
+	select {
+	case <-a.batch.Flushes():
+	case <-time.After(2 * time.Second):
+		t.Fatal("Changes weren't flushed")
+	}
+	a.flush()
+
+	if len(be.ops) != 0 {
+		t.Logf("Unexpected single operations %v", be.ops)
+		t.Fail()
+	}
+
+	if len(be.applied) != 1 || len(be.applied[0]) != 2 ||
+		be.applied[0][0].Type != shared.EventRemove ||
+		be.applied[0][1].Endpoint != e2 {
+		t.Logf("Unexpected changes applied %+v", be.applied)
+		t.Fail()
+	}
+}
+
+// fakeSource sends a single event and blocks until it's stopped.
+type fakeSource struct {
+	cce     chan *shared.ChangeEvent
+	stopped chan bool
+}
+
+func (fs *fakeSource) Start(ctx context.Context) error {
+	fs.cce <- shared.NewChangeEvent(shared.EventAdd, "example.com", *shared.NewEndpoint("http", "10.0.0.1", 80))
+	<-ctx.Done()
+	close(fs.stopped)
+	return nil
+}
+
+func TestApplicationShutdown(t *testing.T) {
+	fs := &fakeSource{stopped: make(chan bool)}
+	sources.SourceMap["fake"] = func(opt shared.OptionMap, cce chan *shared.ChangeEvent) (sources.Source, error) {
+		fs.cce = cce
+		return fs, nil
+	}
+	defer delete(sources.SourceMap, "fake")
+
+	be := &fakeApplier{}
+	cfg := NewConfig()
+	cfg.Backend = NewBackend("fake", nil)
+	cfg.Sources = []*Source{NewSource("fake", nil)}
+	cfg.Options["http_listen"] = "127.0.0.1:0"
+	cfg.Options["apply_delay"] = "1h"
+	a := NewApplication(cfg, be, make(chan bool))
+
+	if n := a.StartSources(); n != 1 {
+		t.Fatalf("Expected 1 source, started %d", n)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		done <- a.Start(ctx)
+	}()
+
+	for i := 0; a.Snapshot.Get()["example.com"] == nil; i++ {
+		if i > 100 {
+			t.Fatal("Event from source not received")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	cancel()
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Application didn't shut down")
+	}
+
+	select {
+	case <-fs.stopped:
+	default:
+		t.Log("Source wasn't stopped")
+		t.Fail()
+	}
+
+	if len(be.applied) != 1 {
+		t.Logf("Queued changes weren't applied on shutdown %+v", be.applied)
+		t.Fail()
+	}
+}
+
+// fakeDrainer is a backend that can drain endpoints.
+type fakeDrainer struct {
+	fakeBackend
+}
+
+func (fd *fakeDrainer) DrainEndpoint(ctx context.Context, h shared.Host, e shared.Endpoint) error {
+	fd.ops = append(fd.ops, "drain "+string(h)+" "+e.String())
+	return nil
+}
+
+func TestDrain(t *testing.T) {
+	be := &fakeDrainer{}
+	cfg := NewConfig()
+	cfg.Backend = NewBackend("fake", nil)
+	cfg.Options["drain_delay"] = "10ms"
+	a := NewApplication(cfg, be, make(chan bool))
+
+	e1 := *shared.NewEndpoint("http", "10.0.0.1", 80)
+	e2 := *shared.NewEndpoint("http", "10.0.0.2", 80)
+	for _, ce := range []*shared.ChangeEvent{
+		shared.NewChangeEvent(shared.EventAdd, "example.com", e1),
+		shared.NewChangeEvent(shared.EventAdd, "example.com", e2),
+		shared.NewChangeEvent(shared.EventDrain, "example.com", e1),
+		shared.NewChangeEvent(shared.EventDrain, "example.com", e2),
+		shared.NewChangeEvent(shared.EventAdd, "example.com", e2),
+	} {
+		ce.Source = "docker"
+		a.receive(ce)
+	}
+
+	if eps := a.expectedRoutes()["example.com"]; len(eps) != 1 || eps[0] != e2 {
+		t.Logf("Drained route expected in the backend %v", eps)
+		t.Fail()
+	}
+
+	select {
+	case d := <-a.dc:
+		a.finishDrain(d)
+	case <-time.After(2 * time.Second):
+		t.Fatal("Drain didn't finish")
+	}
+
+	expected := []string{
+		"add example.com http://10.0.0.1:80",
+		"add example.com http://10.0.0.2:80",
+		"drain example.com http://10.0.0.1:80",
+		"drain example.com http://10.0.0.2:80",
+		"add example.com http://10.0.0.2:80",
+		"remove example.com http://10.0.0.1:80",
+	}
+	if strings.Join(be.ops, "\n") != strings.Join(expected, "\n") {
+		t.Logf("Unexpected operations %v", be.ops)
+		t.Fail()
+	}
+
+	if a.Routes.Applied("example.com", e1) || !a.Routes.Applied("example.com", e2) {
+		t.Logf("Unexpected routes %v", a.Routes)
+		t.Fail()
+	}
+}
+
+// waitProbes handles probe results until done returns true.
+func waitProbes(t *testing.T, a *Application, done func() bool) {
+	timeout := time.After(2 * time.Second)
+	for !done() {
+		select {
+		case r := <-a.pc:
+			a.probed(r)
+		case <-timeout:
+			t.Fatal("Timed out waiting for health checks")
+		}
+	}
+}
+
+func TestHealthCheck(t *testing.T) {
+	var healthy int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/health" || r.Host != "example.com" || atomic.LoadInt32(&healthy) == 0 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer srv.Close()
+
+	be := &fakeBackend{}
+	a := newTestApplication(be)
+	defer close(a.done)
+
+	ep, err := shared.NewEndpointFromUrl(srv.URL + "?health_path=/health&health_interval=10ms&health_rise=1&health_fall=2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ce := shared.NewChangeEvent(shared.EventAdd, "example.com", *ep)
+	ce.Source = "docker"
+
+	if res, _ := a.handleEvent(ce); res != hipdate.ResultHeld || len(be.ops) != 0 {
+		t.Logf("Expected the endpoint to be held, got %s %v", res, be.ops)
+		t.Fail()
+	}
+
+	p := a.probes[route{"example.com", ep.Bare()}]
+	waitProbes(t, a, func() bool { return p.fails > 2 })
+	if len(be.ops) != 0 || len(a.expectedRoutes()["example.com"]) != 0 {
+		t.Logf("Unhealthy endpoint was applied %v", be.ops)
+		t.Fail()
+	}
+
+	atomic.StoreInt32(&healthy, 1)
+	waitProbes(t, a, func() bool { return p.up })
+	if len(be.ops) != 1 || !strings.HasPrefix(be.ops[0], "add example.com") {
+		t.Logf("Unexpected operations %v", be.ops)
+		t.Fail()
+	}
+
+	atomic.StoreInt32(&healthy, 0)
+	waitProbes(t, a, func() bool { return !p.up })
+	if len(be.ops) != 2 || !strings.HasPrefix(be.ops[1], "remove example.com") || p.fails != 2 {
+		t.Logf("Unexpected operations %v after %d failures", be.ops, p.fails)
+		t.Fail()
+	}
+
+	ce = shared.NewChangeEvent(shared.EventRemove, "example.com", *ep)
+	ce.Source = "docker"
+	a.handleEvent(ce)
+	if len(be.ops) != 2 || len(a.probes) != 0 || a.Routes.Applied("example.com", *ep) {
+		t.Logf("Unexpected operations %v and probes %v after removal", be.ops, a.probes)
+		t.Fail()
+	}
+}
+
+// addressSource announces its address option for example.org until it's
+// stopped.
+type addressSource struct {
+	cce     chan *shared.ChangeEvent
+	address string
+}
+
+func (as *addressSource) Start(ctx context.Context) error {
+	as.cce <- shared.NewChangeEvent(shared.EventAdd, "example.org", *shared.NewEndpoint("http", as.address, 80))
+	<-ctx.Done()
+	return nil
+}
+
+// receiveEvents handles n events from the sources.
+func receiveEvents(t *testing.T, a *Application, n int) {
+	for i := 0; i < n; i++ {
+		select {
+		case ce := <-a.EventStream:
+			a.receive(ce)
+		case <-time.After(2 * time.Second):
+			t.Fatalf("Received %d of %d events", i, n)
+		}
+	}
+}
+
+func writeConfig(t *testing.T, p string, cfg Config) {
+	b, err := json.Marshal(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := ioutil.WriteFile(p, b, 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestReload(t *testing.T) {
+	sources.SourceMap["fake"] = func(opt shared.OptionMap, cce chan *shared.ChangeEvent) (sources.Source, error) {
+		return &addressSource{cce: cce, address: opt["address"]}, nil
+	}
+	defer delete(sources.SourceMap, "fake")
+
+	bes := []*fakeBackend{}
+	backends.BackendMap["fake"] = func(opt shared.OptionMap) (backends.Backend, error) {
+		be := &fakeBackend{}
+		bes = append(bes, be)
+		return be, nil
+	}
+	defer delete(backends.BackendMap, "fake")
+
+	f, err := ioutil.TempFile("", "hipdated")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	defer os.Remove(f.Name())
+	*cfgFile = f.Name()
+	defer func() { *cfgFile = "" }()
+
+	cfg := NewConfig()
+	cfg.Backend = NewBackend("fake", shared.OptionMap{"id": "1"})
+	cfg.Sources = []*Source{
+		NewSource("static", shared.OptionMap{"example.com": "http://10.0.0.1:80"}),
+		NewSource("fake", shared.OptionMap{"address": "10.0.1.1"}),
+	}
+	cfg.Options["reload_grace"] = "10ms"
+
+	be := &fakeBackend{}
+	a := NewApplication(cfg, be, make(chan bool))
+	a.http, _ = hipdate.NewHttpServer(be, nil)
+	a.StartSources()
+	defer func() {
+		for _, si := range a.Sources {
+			si.cancel()
+		}
+	}()
+	receiveEvents(t, a, 2)
+
+	cfg.Backend = NewBackend("fake", shared.OptionMap{"id": "2"})
+	cfg.Sources = []*Source{
+		NewSource("static", shared.OptionMap{"example.com": "http://10.0.0.2:80"}),
+		NewSource("fake", shared.OptionMap{"address": "10.0.1.2"}),
+	}
+	writeConfig(t, f.Name(), cfg)
+
+	si := a.Sources["fake"]
+	a.Reload()
+
+	if len(bes) != 1 || a.rawBackend() != bes[0] {
+		t.Fatalf("Backend wasn't replaced, %d created", len(bes))
+	}
+
+	sort.Strings(bes[0].ops)
+	if strings.Join(bes[0].ops, "\n") != "add example.com http://10.0.0.1:80\nadd example.org http://10.0.1.1:80" {
+		t.Logf("Routes weren't applied to the new backend %v", bes[0].ops)
+		t.Fail()
+	}
+
+	if a.Sources["fake"] == si || a.Sources["fake"].Config.Options["address"] != "10.0.1.2" {
+		t.Log("Changed source wasn't restarted")
+		t.Fail()
+	}
+
+	// The static source reloads, the fake one is restarted
+	receiveEvents(t, a, 2)
+
+	if !a.Routes.Applied("example.org", *shared.NewEndpoint("http", "10.0.1.1", 80)) {
+		t.Log("Route of the restarted source was removed before the grace period")
+		t.Fail()
+	}
+
+	select {
+	case rs := <-a.swc:
+		a.sweep(rs)
+	case <-time.After(2 * time.Second):
+		t.Fatal("Routes of the restarted source weren't swept")
+	}
+
+	hl := a.Routes.HostList()
+	if len(hl["example.com"]) != 1 || hl["example.com"][0].Address != "10.0.0.2" ||
+		len(hl["example.org"]) != 1 || hl["example.org"][0].Address != "10.0.1.2" {
+		t.Logf("Unexpected routes %v", hl)
+		t.Fail()
+	}
+
+	if len(be.ops) != 2 || len(bes[0].ops) != 6 {
+		t.Logf("Unexpected operations %v on the old and %v on the new backend", be.ops, bes[0].ops)
+		t.Fail()
+	}
+}
+
+var unavailableError = errors.New("backend unavailable")
+
+// flakyBackend fails to add and remove endpoints while failing is set.
+type flakyBackend struct {
+	fakeBackend
+	failing bool
+}
+
+func (fb *flakyBackend) AddEndpoint(ctx context.Context, h shared.Host, e shared.Endpoint) error {
+	if fb.failing {
+		return unavailableError
+	}
+
+	return fb.fakeBackend.AddEndpoint(ctx, h, e)
+}
+
+func (fb *flakyBackend) RemoveEndpoint(ctx context.Context, h shared.Host, e shared.Endpoint) error {
+	if fb.failing {
+		return unavailableError
+	}
+
+	return fb.fakeBackend.RemoveEndpoint(ctx, h, e)
+}
+
+func newRetryApplication(be *flakyBackend) *Application {
+	cfg := NewConfig()
+	cfg.Backend = NewBackend("fake", nil)
+	cfg.Options["retry_max"] = "2"
+	cfg.Options["retry_backoff"] = "1ms"
+	cfg.Options["retry_max_backoff"] = "1ms"
+
+	return NewApplication(cfg, be, make(chan bool))
+}
+
+func TestRetryDeadLetter(t *testing.T) {
+	be := &flakyBackend{failing: true}
+	a := newRetryApplication(be)
+
+	hs, err := hipdate.NewHttpServer(be, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hs.DeadLetters = a.DeadLetters
+	ts := httptest.NewServer(hs)
+	defer ts.Close()
+
+	ep := *shared.NewEndpoint("http", "10.0.0.1", 80)
+	ce := shared.NewChangeEvent(shared.EventAdd, "example.com", ep)
+	ce.Source = "static"
+	a.receive(ce)
+
+	for i := 0; i < 2; i++ {
+		select {
+		case r := <-a.rtc:
+			a.runRetry(r)
+		case <-time.After(2 * time.Second):
+			t.Fatalf("Retry %d wasn't scheduled", i+1)
+		}
+	}
+
+	rs := a.History.Query(hipdate.HistoryFilter{})
+	if len(rs) != 3 || rs[1].Attempt != 2 || rs[2].Attempt != 3 || rs[2].Result != hipdate.ResultFailed {
+		t.Logf("Unexpected history of %d events", len(rs))
+		t.Fail()
+	}
+
+	dls := a.DeadLetters.List()
+	if len(a.retries) != 0 || len(dls) != 1 || dls[0].Attempts != 3 || dls[0].Event != ce {
+		t.Fatalf("Event wasn't dead lettered after retry_max retries %v %v", a.retries, dls)
+	}
+
+	be.failing = false
+	done := make(chan *http.Response)
+	go func() {
+		resp, err := http.Post(ts.URL+"/api/v1/deadletter/replay", "", nil)
+		if err != nil {
+			t.Error(err)
+		}
+		done <- resp
+	}()
+
+	select {
+	case dls := <-a.DeadLetters.Replays():
+		a.replay(dls)
+	case <-time.After(2 * time.Second):
+		t.Fatal("Dead letter wasn't replayed")
+	}
+
+	if resp := <-done; resp == nil || resp.StatusCode != 200 {
+		t.Logf("Unexpected replay response %v", resp)
+		t.Fail()
+	}
+
+	if a.DeadLetters.Len() != 0 || len(be.ops) != 1 || !a.Routes.Applied("example.com", ep) {
+		t.Logf("Replay wasn't applied %v", be.ops)
+		t.Fail()
+	}
+}
+
+func TestRetryCancelled(t *testing.T) {
+	be := &flakyBackend{failing: true}
+	a := newRetryApplication(be)
+
+	ep := *shared.NewEndpoint("http", "10.0.0.1", 80)
+	for _, k := range []shared.EventKind{shared.EventAdd, shared.EventRemove} {
+		ce := shared.NewChangeEvent(k, "example.com", ep)
+		ce.Source = "static"
+		a.receive(ce)
+
+		if k == shared.EventAdd && len(a.retries) != 1 {
+			t.Fatal("Retry wasn't scheduled")
+		}
+	}
+	be.failing = false
+
+	if len(a.retries) != 0 {
+		t.Logf("Retry wasn't cancelled by the newer event %v", a.retries)
+		t.Fail()
+	}
+
+	// A retry that fired before it was cancelled is dropped
+	select {
+	case r := <-a.rtc:
+		a.runRetry(r)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	if len(be.ops) != 0 || a.Routes.Applied("example.com", ep) || a.DeadLetters.Len() != 0 {
+		t.Logf("Cancelled retry was applied %v", be.ops)
+		t.Fail()
+	}
+}
+
+// pathlessBackend can't route hosts with a path.
+type pathlessBackend struct {
+	fakeBackend
+}
+
+func (pb *pathlessBackend) CheckRoute(h shared.Host) error {
+	if h.Path() != "" {
+		return errors.New("paths not supported")
+	}
+
+	return nil
+}
+
+func TestRejectedRoutes(t *testing.T) {
+	be := &pathlessBackend{}
+	cfg := NewConfig()
+	cfg.Backend = NewBackend("fake", nil)
+	a := NewApplication(cfg, be, make(chan bool))
+
+	ep := *shared.NewEndpoint("http", "10.0.0.1", 80)
+	for _, k := range []shared.EventKind{shared.EventAdd, shared.EventAdd, shared.EventDrain} {
+		ce := shared.NewChangeEvent(k, "example.com/api", ep)
+		ce.Source = "docker"
+		a.receive(ce)
+	}
+
+	if len(be.ops) != 0 || len(a.retries) != 0 || a.DeadLetters.Len() != 0 {
+		t.Logf("Rejected route was applied or retried %v", be.ops)
+		t.Fail()
+	}
+
+	if !a.Routes.Applied("example.com/api", ep) || len(a.expectedRoutes()) != 0 {
+		t.Logf("Rejected route should be owned but not expected in the backend %v", a.expectedRoutes())
+		t.Fail()
+	}
+
+	a.checkDrift()
+	if dr := a.Drift.Last(); !dr.InSync() {
+		t.Logf("Rejected route reported as drift %+v", dr)
+		t.Fail()
+	}
+
+	ce := shared.NewChangeEvent(shared.EventRemove, "example.com/api", ep)
+	ce.Source = "docker"
+	a.receive(ce)
+
+	if len(be.ops) != 0 || a.Routes.Applied("example.com/api", ep) {
+		t.Logf("Unexpected operations %v removing a rejected route", be.ops)
+		t.Fail()
+	}
+
+	for _, r := range a.History.Query(hipdate.HistoryFilter{}) {
+		if r.Result != hipdate.ResultSkipped && r.Result != hipdate.ResultApplied {
+			t.Logf("Unexpected %s result for a rejected route", r.Result)
+			t.Fail()
+		}
+	}
+}
+
+func TestBatcherDeadLetter(t *testing.T) {
+	be := &fakeApplier{failing: true}
+	cfg := NewConfig()
+	cfg.Backend = NewBackend("fake", nil)
+	cfg.Options["apply_delay"] = "1ms"
+	cfg.Options["retry_max"] = "2"
+	cfg.Options["retry_backoff"] = "1ms"
+	cfg.Options["retry_max_backoff"] = "1ms"
+	a := NewApplication(cfg, be, make(chan bool))
+
+	ep := *shared.NewEndpoint("http", "10.0.0.1", 80)
+	ce := shared.NewChangeEvent(shared.EventAdd, "example.com", ep)
+	ce.Source = "static"
+	a.receive(ce)
+
+	if n := len(a.History.Query(hipdate.HistoryFilter{})); n != 0 {
+		t.Logf("Expected no outcome before the flush, got %d", n)
+		t.Fail()
+	}
+
+	for i := 0; i < 3; i++ {
+		waitFlush(t, a)
+	}
+
+	rs := a.History.Query(hipdate.HistoryFilter{})
+	for i, r := range rs {
+		if r.Result != hipdate.ResultFailed || r.Attempt != i {
+			t.Logf("Unexpected record %+v", r)
+			t.Fail()
+		}
+	}
+
+	dls := a.DeadLetters.List()
+	if len(rs) != 3 || len(a.batch.pending) != 0 || len(dls) != 1 || dls[0].Attempts != 3 || dls[0].Event != ce {
+		t.Fatalf("Change wasn't dead lettered after retry_max retries %v %v", a.batch.pending, dls)
+	}
+
+	if a.Routes.Applied("example.com", ep) {
+		t.Log("Route of the dead letter wasn't reverted")
+		t.Fail()
+	}
+
+	be.failing = false
+	a.replay(a.DeadLetters.Take(0))
+	waitFlush(t, a)
+
+	rs = a.History.Query(hipdate.HistoryFilter{})
+	if r := rs[len(rs)-1]; len(rs) != 4 || r.Result != hipdate.ResultApplied || r.Attempt != 4 {
+		t.Logf("Unexpected outcome of the replay %+v", r)
+		t.Fail()
+	}
+
+	if len(be.applied) != 1 || !a.Routes.Applied("example.com", ep) {
+		t.Logf("Replay wasn't applied %v", be.applied)
+		t.Fail()
+	}
+}
+
+func TestDeadLetterSuperseded(t *testing.T) {
+	be := &flakyBackend{failing: true}
+	a := newRetryApplication(be)
+
+	ep := *shared.NewEndpoint("http", "10.0.0.1", 80)
+	ce := shared.NewChangeEvent(shared.EventAdd, "example.com", ep)
+	ce.Source = "docker"
+	a.receive(ce)
+
+	for i := 0; i < 2; i++ {
+		select {
+		case r := <-a.rtc:
+			a.runRetry(r)
+		case <-time.After(2 * time.Second):
+			t.Fatalf("Retry %d wasn't scheduled", i+1)
+		}
+	}
+
+	if a.DeadLetters.Len() != 1 {
+		t.Fatal("Add wasn't dead lettered")
+	}
+
+	be.failing = false
+	ce = shared.NewChangeEvent(shared.EventRemove, "example.com", ep)
+	ce.Source = "docker"
+	a.receive(ce)
+
+	a.replay(a.DeadLetters.Take(0))
+	if a.DeadLetters.Len() != 0 || len(be.ops) != 0 || a.Routes.Applied("example.com", ep) {
+		t.Logf("Superseded dead letter was replayed %v %v", be.ops, a.Routes)
+		t.Fail()
+	}
+}
+
+func TestBatcherDeadLetterSuperseded(t *testing.T) {
+	be := &fakeApplier{failing: true}
+	cfg := NewConfig()
+	cfg.Backend = NewBackend("fake", nil)
+	cfg.Options["apply_delay"] = "1ms"
+	cfg.Options["retry_max"] = "0"
+	a := NewApplication(cfg, be, make(chan bool))
+
+	ep := *shared.NewEndpoint("http", "10.0.0.1", 80)
+	ce := shared.NewChangeEvent(shared.EventAdd, "example.com", ep)
+	ce.Source = "docker"
+	a.receive(ce)
+	waitFlush(t, a)
+
+	if a.DeadLetters.Len() != 1 {
+		t.Fatal("Add wasn't dead lettered")
+	}
+
+	be.failing = false
+	ce = shared.NewChangeEvent(shared.EventRemove, "example.com", ep)
+	ce.Source = "docker"
+	a.receive(ce)
+
+	a.replay(a.DeadLetters.Take(0))
+	if len(a.batch.pending) != 0 || len(be.applied) != 0 || a.Routes.Applied("example.com", ep) {
+		t.Logf("Superseded dead letter was replayed %v %v", a.batch.pending, a.Routes)
+		t.Fail()
+	}
+}
+
+// stockedBackend already has routes, and records whether it was cleared.
+type stockedBackend struct {
+	fakeBackend
+	hosts   shared.HostList
+	cleared bool
+}
+
+func (sb *stockedBackend) ListHosts(ctx context.Context) (*shared.HostList, error) {
+	return &sb.hosts, nil
+}
+
+func (sb *stockedBackend) Initialise(ctx context.Context) error {
+	sb.cleared = true
+	return nil
+}
+
+func TestSwapBackendKeepsRoutes(t *testing.T) {
+	e1 := *shared.NewEndpoint("http", "10.0.0.1", 80)
+	e2 := *shared.NewEndpoint("http", "10.0.0.2", 80)
+	sb := &stockedBackend{hosts: shared.HostList{"example.com": {e1}, "old.com": {e2}}}
+	backends.BackendMap["fake"] = func(opt shared.OptionMap) (backends.Backend, error) {
+		return sb, nil
+	}
+	defer delete(backends.BackendMap, "fake")
+
+	be := &fakeBackend{}
+	a := newTestApplication(be)
+	a.http, _ = hipdate.NewHttpServer(be, nil)
+
+	ce := shared.NewChangeEvent(shared.EventAdd, "example.com", e1)
+	ce.Source = "static"
+	a.receive(ce)
+
+	cfg := NewConfig()
+	cfg.Backend = NewBackend("fake", shared.OptionMap{"delete_empty": "true"})
+	if err := a.swapBackend(cfg); err != nil {
+		t.Fatal(err)
+	}
+
+	sort.Strings(sb.ops)
+	expected := "add example.com http://10.0.0.1:80\nremove old.com http://10.0.0.2:80"
+	if sb.cleared || a.rawBackend() != sb || strings.Join(sb.ops, "\n") != expected {
+		t.Logf("Unexpected operations %v on the new backend, cleared: %t", sb.ops, sb.cleared)
+		t.Fail()
+	}
+}
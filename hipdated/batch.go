@@ -0,0 +1,162 @@
+package main
+
+import (
+	"context"
+	"github.com/3onyc/hipdate/backends"
+	"github.com/3onyc/hipdate/shared"
+	"time"
+)
+
+const (
+	DefaultApplyDelay    = 200 * time.Millisecond
+	DefaultApplyMaxDelay = 2 * time.Second
+)
+
+// batcher wraps a backend implementing backends.Applier, queueing the changes
+// until none arrived for the delay, or the max delay has passed since the
+// first one. Changes to the same route replace each other, only the last one
+// is applied.
+type batcher struct {
+	backends.Backend
+	ap       backends.Applier
+	delay    time.Duration
+	maxDelay time.Duration
+	pending  []*queued
+	index    map[route]int
+	first    time.Time
+	timer    *time.Timer
+	failures int
+	fc       chan bool
+}
+
+// queued is a change waiting to be applied, along with the events whose
+// outcome depends on it, and the number of times applying it failed.
+type queued struct {
+	backends.Change
+	events   []tracked
+	failures int
+}
+
+// tracked is an event whose outcome is recorded once its change is applied.
+type tracked struct {
+	ce      *shared.ChangeEvent
+	attempt int
+}
+
+func newBatcher(be backends.Backend, ap backends.Applier, delay, maxDelay time.Duration) *batcher {
+	return &batcher{
+		Backend:  be,
+		ap:       ap,
+		delay:    delay,
+		maxDelay: maxDelay,
+		index:    map[route]int{},
+		fc:       make(chan bool, 1),
+	}
+}
+
+func (b *batcher) AddEndpoint(ctx context.Context, h shared.Host, e shared.Endpoint) error {
+	b.queue(backends.Change{Type: shared.EventAdd, Host: h, Endpoint: e})
+	return nil
+}
+
+func (b *batcher) RemoveEndpoint(ctx context.Context, h shared.Host, e shared.Endpoint) error {
+	b.queue(backends.Change{Type: shared.EventRemove, Host: h, Endpoint: e})
+	return nil
+}
+
+func (b *batcher) queue(c backends.Change) {
+	b.put(&queued{Change: c})
+
+	now := time.Now()
+	if b.timer == nil {
+		b.first = now
+		b.timer = time.AfterFunc(b.delay, b.fire)
+		return
+	}
+
+	d := b.delay
+	if left := b.maxDelay - now.Sub(b.first); left < d {
+		d = left
+	}
+	if d < 0 {
+		d = 0
+	}
+	b.timer.Reset(d)
+}
+
+// put adds a change to the queue, replacing the one queued for the same route
+// but keeping its events.
+func (b *batcher) put(q *queued) {
+	k := route{q.Host, q.Endpoint.Bare()}
+	i, ok := b.index[k]
+	if !ok {
+		b.index[k] = len(b.pending)
+		b.pending = append(b.pending, q)
+		return
+	}
+
+	p := b.pending[i]
+	p.Change, p.failures = q.Change, q.failures
+	p.events = append(p.events, q.events...)
+}
+
+// track attaches an event to the change queued for its route, returning false
+// if it didn't queue one.
+func (b *batcher) track(ce *shared.ChangeEvent, attempt int) bool {
+	i, ok := b.index[route{ce.Host, ce.Endpoint.Bare()}]
+	if !ok || b.pending[i].Type != ce.Type {
+		return false
+	}
+
+	q := b.pending[i]
+	q.events = append(q.events, tracked{ce, attempt})
+
+	return true
+}
+
+func (b *batcher) fire() {
+	select {
+	case b.fc <- true:
+	default:
+	}
+}
+
+// Flushes receives when the queued changes are due to be applied.
+func (b *batcher) Flushes() <-chan bool {
+	if b == nil {
+		return nil
+	}
+
+	return b.fc
+}
+
+// take returns the queued changes, emptying the queue.
+func (b *batcher) take() []*queued {
+	cs := b.pending
+	b.pending = nil
+	b.index = map[route]int{}
+	if b.timer != nil {
+		b.timer.Stop()
+		b.timer = nil
+	}
+
+	return cs
+}
+
+// requeue puts changes that failed to apply back in front of the ones queued
+// since, and schedules them to be applied again after d.
+func (b *batcher) requeue(qs []*queued, d time.Duration) {
+	newer := b.take()
+	for _, q := range append(qs, newer...) {
+		b.put(q)
+	}
+
+	b.first = time.Now()
+	b.timer = time.AfterFunc(d, b.fire)
+}
+
+func (b *batcher) stop() {
+	if b.timer != nil {
+		b.timer.Stop()
+	}
+}
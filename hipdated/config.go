@@ -5,6 +5,7 @@ import (
 	docker "github.com/fsouza/go-dockerclient"
 	"log"
 	"os"
+	"strconv"
 	"strings"
 )
 
@@ -21,6 +22,10 @@ func NewSource(n string, o shared.OptionMap) *Source {
 	return &Source{n, o}
 }
 
+func (s *Source) Equal(s2 *Source) bool {
+	return s.Name == s2.Name && s.Options.Equal(s2.Options)
+}
+
 type Backend struct {
 	Name    string
 	Options shared.OptionMap
@@ -34,6 +39,14 @@ func NewBackend(n string, o shared.OptionMap) *Backend {
 	return &Backend{n, o}
 }
 
+func (b *Backend) Equal(b2 *Backend) bool {
+	if b == nil || b2 == nil {
+		return b == b2
+	}
+
+	return b.Name == b2.Name && b.Options.Equal(b2.Options)
+}
+
 type Config struct {
 	Backend *Backend
 	Sources []*Source
@@ -64,7 +77,52 @@ func ParseOptions(o string) shared.OptionMap {
 	return shared.OptionMap(opts.Map())
 }
 
-func LoadConfig() Config {
+// SourceKeys identifies the configured sources by name, numbering repeated
+// names in order of appearance (file, file#2, ...), so a source keeps its key
+// across config reloads as long as its position among its namesakes does.
+func SourceKeys(srcs []*Source) map[string]*Source {
+	keys := map[string]*Source{}
+	seen := map[string]int{}
+
+	for _, s := range srcs {
+		seen[s.Name]++
+
+		k := s.Name
+		if n := seen[s.Name]; n > 1 {
+			k += "#" + strconv.Itoa(n)
+		}
+		keys[k] = s
+	}
+
+	return keys
+}
+
+// DiffSources returns the keys of the sources that were added, removed or
+// changed between two sets of keyed sources.
+func DiffSources(old, new map[string]*Source) (added, removed, changed []string) {
+	for k := range old {
+		if _, ok := new[k]; !ok {
+			removed = append(removed, k)
+		}
+	}
+
+	for k, s := range new {
+		o, ok := old[k]
+		switch {
+		case !ok:
+			added = append(added, k)
+		case !o.Equal(s):
+			changed = append(changed, k)
+		}
+	}
+
+	return added, removed, changed
+}
+
+// LoadConfig returns the merged environment and JSON config, the error is
+// set if the config file couldn't be loaded, in which case the returned
+// config only contains the environment part.
+func LoadConfig() (Config, error) {
 	log.Println("NOTICE Loading config...")
 
 	cfg := NewConfig()
@@ -73,11 +131,11 @@ func LoadConfig() Config {
 	if *cfgFile != "" {
 		cfg2, err := ConfigParseJson(*cfgFile)
 		if err != nil {
-			log.Printf("ERROR Failed to load %s: %s\n", *cfgFile, err)
-		} else {
-			cfg.Merge(*cfg2)
+			return cfg, err
 		}
+
+		cfg.Merge(*cfg2)
 	}
 
-	return cfg
+	return cfg, nil
 }
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"github.com/3onyc/hipdate/shared"
 	"testing"
 )
 
@@ -59,3 +60,60 @@ func TestConfigMergeOptions(t *testing.T) {
 		t.Fail()
 	}
 }
+
+func TestSourceKeys(t *testing.T) {
+	keys := SourceKeys([]*Source{
+		NewSource("file", nil),
+		NewSource("docker", nil),
+		NewSource("file", nil),
+	})
+
+	for _, k := range []string{"file", "file#2", "docker"} {
+		if _, ok := keys[k]; !ok {
+			t.Logf("Key '%s' missing from %v", k, keys)
+			t.Fail()
+		}
+	}
+}
+
+func TestDiffSources(t *testing.T) {
+	old := map[string]*Source{
+		"file":   NewSource("file", shared.OptionMap{"path": "/a"}),
+		"docker": NewSource("docker", shared.OptionMap{"url": "unix:///a"}),
+		"static": NewSource("static", shared.OptionMap{"a.com": "http://a:80"}),
+	}
+	new := map[string]*Source{
+		"file":   NewSource("file", shared.OptionMap{"path": "/b"}),
+		"docker": NewSource("docker", shared.OptionMap{"url": "unix:///a"}),
+		"file#2": NewSource("file", shared.OptionMap{"path": "/c"}),
+	}
+
+	added, removed, changed := DiffSources(old, new)
+	if len(added) != 1 || added[0] != "file#2" {
+		t.Logf("Unexpected added sources %v", added)
+		t.Fail()
+	}
+	if len(removed) != 1 || removed[0] != "static" {
+		t.Logf("Unexpected removed sources %v", removed)
+		t.Fail()
+	}
+	if len(changed) != 1 || changed[0] != "file" {
+		t.Logf("Unexpected changed sources %v", changed)
+		t.Fail()
+	}
+}
+
+func TestBackendEqual(t *testing.T) {
+	b1 := NewBackend("hipache", shared.OptionMap{"redis": "redis://a:6379"})
+	b2 := NewBackend("hipache", shared.OptionMap{"redis": "redis://a:6379"})
+	b3 := NewBackend("hipache", shared.OptionMap{"redis": "redis://b:6379"})
+
+	if !b1.Equal(b2) {
+		t.Log("Identical backends not equal")
+		t.Fail()
+	}
+	if b1.Equal(b3) {
+		t.Log("Backends with different options equal")
+		t.Fail()
+	}
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"errors"
 	"flag"
 	"github.com/3onyc/hipdate/backends"
@@ -9,7 +10,6 @@ import (
 	"log"
 	"os"
 	"os/signal"
-	"sync"
 	"syscall"
 
 	_ "github.com/3onyc/hipdate"
@@ -21,11 +21,15 @@ const (
 
 var (
 	BackendNotFoundError = errors.New("backend not found")
+	SourceNotFoundError  = errors.New("source not found")
 )
 
 func main() {
 	flag.Parse()
-	cfg := LoadConfig()
+	cfg, err := LoadConfig()
+	if err != nil {
+		log.Printf("ERROR Failed to load %s: %s\n", *cfgFile, err)
+	}
 
 	if cfg.Backend == nil {
 		log.Fatalln("FATAL No backend selected")
@@ -35,16 +39,10 @@ func main() {
 		log.Fatalln("FATAL No sources selected")
 	}
 
-	wg := &sync.WaitGroup{}
-	ce := make(chan *shared.ChangeEvent)
-	sc := make(chan bool)
+	ctx, cancel := context.WithCancel(context.Background())
+	rc := make(chan bool)
 
-	registerSignals(sc)
-
-	srcs := InitSources(cfg, ce, wg, sc)
-	if len(srcs) == 0 {
-		log.Fatalf("FATAL All sources failed to initialise")
-	}
+	registerSignals(cancel, rc)
 
 	be, err := InitBackend(cfg)
 	switch {
@@ -54,37 +52,27 @@ func main() {
 		log.Fatalf("FATAL [backend:%s] %s", cfg.Backend.Name, err)
 	}
 
-	app := NewApplication(be, srcs, ce, wg, sc)
+	app := NewApplication(cfg, be, rc)
+	if n := app.StartSources(); n == 0 {
+		log.Fatalf("FATAL All sources failed to initialise")
+	}
 
 	log.Println("NOTICE Starting...")
-	app.Start()
+	if err := app.Start(ctx); err != nil {
+		log.Fatalln("FATAL", err)
+	}
 }
 
-func InitSources(
-	cfg Config,
+func InitSource(
+	s *Source,
 	ce chan *shared.ChangeEvent,
-	wg *sync.WaitGroup,
-	sc chan bool,
-) []sources.Source {
-	srcs := []sources.Source{}
-
-	for _, s := range cfg.Sources {
-		srcInitFn, ok := sources.SourceMap[s.Name]
-		if !ok {
-			log.Printf("ERROR Source '%s' not found\n", s.Name)
-			continue
-		}
-
-		src, err := srcInitFn(s.Options, ce, wg, sc)
-		if err != nil {
-			log.Printf("ERROR [source:%s] %s", s.Name, err)
-			continue
-		}
-
-		srcs = append(srcs, src)
+) (sources.Source, error) {
+	srcInitFn, ok := sources.SourceMap[s.Name]
+	if !ok {
+		return nil, SourceNotFoundError
 	}
 
-	return srcs
+	return srcInitFn(s.Options, ce)
 }
 
 func InitBackend(cfg Config) (backends.Backend, error) {
@@ -101,11 +89,20 @@ func InitBackend(cfg Config) (backends.Backend, error) {
 	return be, nil
 }
 
-func registerSignals(sc chan bool) {
-	c := make(chan os.Signal)
-	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
+// registerSignals cancels the context of the application on SIGINT or
+// SIGTERM, and signals rc on SIGHUP.
+func registerSignals(cancel context.CancelFunc, rc chan bool) {
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, os.Interrupt, syscall.SIGTERM, syscall.SIGHUP)
 	go func() {
-		_ = <-c
-		close(sc)
+		for s := range c {
+			if s == syscall.SIGHUP {
+				rc <- true
+				continue
+			}
+
+			cancel()
+			return
+		}
 	}()
 }
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/3onyc/hipdate/shared"
+	"log"
+	"net/http"
+	"time"
+)
+
+const (
+	DefaultCheckInterval = 10 * time.Second
+	DefaultCheckTimeout  = 5 * time.Second
+	DefaultCheckRise     = 2
+	DefaultCheckFall     = 3
+)
+
+// probe checks the health of a route, up is set once the route passed its
+// rise threshold and cleared once it failed its fall threshold. Routes with a
+// probe are only in the backend while they're up.
+type probe struct {
+	route
+	check  shared.HealthCheck
+	up     bool
+	passes int
+	fails  int
+	cancel context.CancelFunc
+}
+
+// probeResult is the outcome of a single check.
+type probeResult struct {
+	p   *probe
+	err error
+}
+
+// checkDefaults fills in the defaults of the settings a health check leaves
+// out.
+func checkDefaults(hc shared.HealthCheck) shared.HealthCheck {
+	if hc.Interval == 0 {
+		hc.Interval = DefaultCheckInterval
+	}
+	if hc.Rise == 0 {
+		hc.Rise = DefaultCheckRise
+	}
+	if hc.Fall == 0 {
+		hc.Fall = DefaultCheckFall
+	}
+
+	return hc
+}
+
+// watch starts, replaces or stops the probe of a route to match the health
+// check of its endpoint. A new probe starts up if the route is applied, which
+// for a route that had a probe depends on whether that was up.
+func (a *Application) watch(h shared.Host, ep shared.Endpoint, applied bool) {
+	if a.rejects(h) {
+		return
+	}
+
+	k := route{h, ep.Bare()}
+	hc := checkDefaults(a.Routes.Endpoint(h, ep).Check)
+
+	if p, ok := a.probes[k]; ok {
+		if p.check == hc {
+			return
+		}
+		applied = a.unwatch(k)
+	}
+
+	if !hc.Enabled() {
+		if !applied {
+			a.applyRoute(k)
+		}
+		return
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	p := &probe{route: k, check: hc, up: applied, cancel: cancel}
+	a.probes[k] = p
+
+	go a.runProbe(ctx, p, durationOption(a.Config.Options, "health_timeout", DefaultCheckTimeout))
+}
+
+// unwatch stops the probe of a route, returning whether its health check let
+// it in the backend.
+func (a *Application) unwatch(k route) bool {
+	p, ok := a.probes[k]
+	if !ok {
+		return true
+	}
+
+	p.cancel()
+	delete(a.probes, k)
+
+	return p.up
+}
+
+// healthy returns whether a route passes its health check, if it has one.
+func (a *Application) healthy(k route) bool {
+	p, ok := a.probes[k]
+	return !ok || p.up
+}
+
+// runProbe checks a route every interval until it's unwatched, the results
+// are handled by the event listener.
+func (a *Application) runProbe(ctx context.Context, p *probe, timeout time.Duration) {
+	c := &http.Client{Timeout: timeout}
+	t := time.NewTicker(p.check.Interval)
+	defer t.Stop()
+
+	for {
+		r := probeResult{p, checkEndpoint(ctx, c, p.Host, p.Endpoint, p.check)}
+		select {
+		case a.pc <- r:
+		case <-ctx.Done():
+			return
+		case <-a.done:
+			return
+		}
+
+		select {
+		case <-t.C:
+		case <-ctx.Done():
+			return
+		case <-a.done:
+			return
+		}
+	}
+}
+
+// checkEndpoint requests the health check path of an endpoint with the name
+// of the host, and returns an error unless it gets the expected status.
+func checkEndpoint(
+	ctx context.Context,
+	c *http.Client,
+	h shared.Host,
+	ep shared.Endpoint,
+	hc shared.HealthCheck,
+) error {
+	req, err := http.NewRequest("GET", ep.String()+hc.Path, nil)
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+	req.Host = h.Name()
+
+	resp, err := c.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	if hc.Status == 0 && resp.StatusCode >= 200 && resp.StatusCode < 400 || resp.StatusCode == hc.Status {
+		return nil
+	}
+
+	return fmt.Errorf("%s returned %s", hc.Path, resp.Status)
+}
+
+// probed counts the result of a check, and adds or removes the route once it
+// passed its rise or failed its fall threshold.
+func (a *Application) probed(r probeResult) {
+	p := r.p
+	if a.probes[p.route] != p {
+		return
+	}
+
+	if r.err != nil {
+		p.passes = 0
+		p.fails++
+	} else {
+		p.fails = 0
+		p.passes++
+	}
+
+	h, ep := p.Host, a.Routes.Endpoint(p.Host, p.Endpoint)
+	switch {
+	case !p.up && p.passes >= p.check.Rise:
+		if a.applyRoute(p.route) != nil {
+			return
+		}
+		p.up = true
+		log.Printf("NOTICE [health] %s %s is up", h, ep.String())
+	case p.up && p.fails >= p.check.Fall:
+		if d := a.drains[p.route]; d == nil || !d.drained {
+			err := a.observe("remove", func(ctx context.Context) error {
+				return a.Backend.RemoveEndpoint(ctx, h, ep)
+			})
+			if err != nil {
+				log.Println("ERROR Failed to remove unhealthy upstream", err)
+				return
+			}
+		}
+		p.up = false
+		log.Printf("WARN [health] %s %s is down: %s", h, ep.String(), r.err)
+	}
+}
+
+// applyRoute adds a route that its health check held back to the backend,
+// unless it's being drained.
+func (a *Application) applyRoute(k route) error {
+	if d := a.drains[k]; d != nil && d.drained {
+		return nil
+	}
+
+	ep := a.Routes.Endpoint(k.Host, k.Endpoint)
+	err := a.observe("add", func(ctx context.Context) error {
+		return a.Backend.AddEndpoint(ctx, k.Host, ep)
+	})
+	if err != nil {
+		log.Println("ERROR Failed to add upstream", err)
+	}
+
+	return err
+}
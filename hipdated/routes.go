@@ -0,0 +1,116 @@
+package main
+
+import (
+	"github.com/3onyc/hipdate/shared"
+	"sort"
+)
+
+type route struct {
+	Host     shared.Host
+	Endpoint shared.Endpoint
+}
+
+// RouteTable keeps track of the endpoints that have been applied to the
+// backend, and of the sources that want them there. A route without owners
+// stays applied until it's explicitly deleted. Routes failing their health
+// check are kept in the table while they're out of the backend.
+//
+// Endpoints are keyed without their metadata, every owner keeps the endpoint
+// with the metadata it announced.
+type RouteTable map[shared.Host]map[shared.Endpoint]map[string]shared.Endpoint
+
+func (rt RouteTable) Applied(h shared.Host, e shared.Endpoint) bool {
+	_, ok := rt[h][e.Bare()]
+	return ok
+}
+
+func (rt RouteTable) Own(h shared.Host, e shared.Endpoint, src string) {
+	if rt[h] == nil {
+		rt[h] = map[shared.Endpoint]map[string]shared.Endpoint{}
+	}
+
+	k := e.Bare()
+	if rt[h][k] == nil {
+		rt[h][k] = map[string]shared.Endpoint{}
+	}
+
+	rt[h][k][src] = e
+}
+
+// Disown removes src from the owners of a route, and returns whether the
+// route is now left without owners.
+func (rt RouteTable) Disown(h shared.Host, e shared.Endpoint, src string) bool {
+	owners, ok := rt[h][e.Bare()]
+	if !ok {
+		return false
+	}
+
+	if _, ok := owners[src]; !ok {
+		return false
+	}
+
+	delete(owners, src)
+	return len(owners) == 0
+}
+
+// SoleOwner returns whether src is the only owner of a route.
+func (rt RouteTable) SoleOwner(h shared.Host, e shared.Endpoint, src string) bool {
+	owners := rt[h][e.Bare()]
+	_, ok := owners[src]
+	return ok && len(owners) == 1
+}
+
+func (rt RouteTable) Orphaned(h shared.Host, e shared.Endpoint) bool {
+	owners, ok := rt[h][e.Bare()]
+	return ok && len(owners) == 0
+}
+
+func (rt RouteTable) Delete(h shared.Host, e shared.Endpoint) {
+	delete(rt[h], e.Bare())
+	if len(rt[h]) == 0 {
+		delete(rt, h)
+	}
+}
+
+func (rt RouteTable) Owned(src string) []route {
+	rs := []route{}
+	for h, eps := range rt {
+		for _, owners := range eps {
+			if e, ok := owners[src]; ok {
+				rs = append(rs, route{h, e})
+			}
+		}
+	}
+
+	return rs
+}
+
+// Endpoint returns the endpoint of a route with the metadata of its first
+// owner by name, or the bare endpoint if it has no owners.
+func (rt RouteTable) Endpoint(h shared.Host, e shared.Endpoint) shared.Endpoint {
+	owners := rt[h][e.Bare()]
+
+	srcs := []string{}
+	for src := range owners {
+		srcs = append(srcs, src)
+	}
+
+	if len(srcs) == 0 {
+		return e.Bare()
+	}
+
+	sort.Strings(srcs)
+	return owners[srcs[0]]
+}
+
+func (rt RouteTable) HostList() shared.HostList {
+	hl := shared.HostList{}
+	for h, eps := range rt {
+		hl[h] = []shared.Endpoint{}
+		for e := range eps {
+			hl[h] = append(hl[h], rt.Endpoint(h, e))
+		}
+	}
+
+	return hl
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"github.com/3onyc/hipdate/shared"
+	"testing"
+)
+
+func TestRouteTableOwnership(t *testing.T) {
+	rt := RouteTable{}
+	h, e := shared.Host("example.com"), *shared.NewEndpoint("http", "10.0.0.1", 80)
+
+	rt.Own(h, e, "docker")
+	rt.Own(h, e, "file")
+
+	if rt.Disown(h, e, "docker") {
+		t.Log("Route orphaned while still owned by file")
+		t.Fail()
+	}
+
+	if rt.Disown(h, e, "docker") {
+		t.Log("Disowning twice orphaned the route")
+		t.Fail()
+	}
+
+	if !rt.Disown(h, e, "file") || !rt.Orphaned(h, e) {
+		t.Log("Route not orphaned after last owner left")
+		t.Fail()
+	}
+
+	if !rt.Applied(h, e) {
+		t.Log("Orphaned route no longer applied")
+		t.Fail()
+	}
+
+	rt.Delete(h, e)
+	if rt.Applied(h, e) || len(rt) != 0 {
+		t.Log("Route still applied after delete")
+		t.Fail()
+	}
+}
+
+func TestRouteTableOwned(t *testing.T) {
+	rt := RouteTable{}
+	e1, e2 := *shared.NewEndpoint("http", "10.0.0.1", 80), *shared.NewEndpoint("http", "10.0.0.2", 80)
+
+	rt.Own("a.com", e1, "docker")
+	rt.Own("b.com", e2, "docker")
+	rt.Own("b.com", e1, "file")
+
+	if rs := rt.Owned("docker"); len(rs) != 2 {
+		t.Logf("Expected 2 routes owned by docker, got %v", rs)
+		t.Fail()
+	}
+
+	if hl := rt.HostList(); len(hl["b.com"]) != 2 {
+		t.Logf("Expected 2 endpoints for b.com, got %v", hl["b.com"])
+		t.Fail()
+	}
+}
+
+func TestRouteTableMetadata(t *testing.T) {
+	rt := RouteTable{}
+	e := *shared.NewEndpoint("http", "10.0.0.1", 80)
+	we := e
+	we.Weight = 3
+
+	rt.Own("a.com", we, "docker")
+	rt.Own("a.com", e, "file")
+
+	if !rt.Applied("a.com", e) || len(rt["a.com"]) != 1 {
+		t.Log("Endpoint with metadata not treated as the same route")
+		t.Fail()
+	}
+
+	if hl := rt.HostList(); len(hl["a.com"]) != 1 || hl["a.com"][0].Weight != 3 {
+		t.Logf("Expected the metadata of docker, got %v", hl["a.com"])
+		t.Fail()
+	}
+
+	if rt.Disown("a.com", e, "docker") || !rt.Disown("a.com", we, "file") {
+		t.Log("Disowning with different metadata failed")
+		t.Fail()
+	}
+}
@@ -0,0 +1,73 @@
+package hipdate
+
+import (
+	"sync"
+)
+
+const (
+	DefaultHistorySize = 1000
+)
+
+// EventHistory is a ring buffer holding the most recently processed events.
+type EventHistory struct {
+	mu   sync.RWMutex
+	buf  []*EventRecord
+	next int
+	full bool
+}
+
+func NewEventHistory(size int) *EventHistory {
+	if size < 1 {
+		size = DefaultHistorySize
+	}
+
+	return &EventHistory{
+		buf: make([]*EventRecord, size),
+	}
+}
+
+func (eh *EventHistory) Add(r *EventRecord) {
+	eh.mu.Lock()
+	defer eh.mu.Unlock()
+
+	eh.buf[eh.next] = r
+	eh.next = (eh.next + 1) % len(eh.buf)
+	if eh.next == 0 {
+		eh.full = true
+	}
+}
+
+// HistoryFilter selects events by host, source and endpoint URL, empty
+// fields match anything.
+type HistoryFilter struct {
+	Host     string
+	Source   string
+	Endpoint string
+}
+
+func (f HistoryFilter) Match(r *EventRecord) bool {
+	return (f.Host == "" || f.Host == string(r.Host)) &&
+		(f.Source == "" || f.Source == r.Source) &&
+		(f.Endpoint == "" || f.Endpoint == r.Endpoint)
+}
+
+// Query returns the matching events, oldest first.
+func (eh *EventHistory) Query(f HistoryFilter) []*EventRecord {
+	eh.mu.RLock()
+	defer eh.mu.RUnlock()
+
+	rs := []*EventRecord{}
+	start, n := 0, eh.next
+	if eh.full {
+		start, n = eh.next, len(eh.buf)
+	}
+
+	for i := 0; i < n; i++ {
+		r := eh.buf[(start+i)%len(eh.buf)]
+		if f.Match(r) {
+			rs = append(rs, r)
+		}
+	}
+
+	return rs
+}
@@ -0,0 +1,41 @@
+package hipdate
+
+import (
+	"github.com/3onyc/hipdate/shared"
+	"testing"
+)
+
+func historyRecord(id uint64, h shared.Host, src string) *EventRecord {
+	return &EventRecord{Id: id, Host: h, Source: src}
+}
+
+func TestEventHistoryWrapsAround(t *testing.T) {
+	eh := NewEventHistory(3)
+	for i := uint64(1); i <= 5; i++ {
+		eh.Add(historyRecord(i, "example.com", "docker"))
+	}
+
+	rs := eh.Query(HistoryFilter{})
+	if len(rs) != 3 || rs[0].Id != 3 || rs[2].Id != 5 {
+		t.Logf("Unexpected history %v", rs)
+		t.Fail()
+	}
+}
+
+func TestEventHistoryFilter(t *testing.T) {
+	eh := NewEventHistory(10)
+	eh.Add(historyRecord(1, "a.com", "docker"))
+	eh.Add(historyRecord(2, "b.com", "docker"))
+	eh.Add(historyRecord(3, "a.com", "file"))
+
+	if rs := eh.Query(HistoryFilter{Host: "a.com"}); len(rs) != 2 {
+		t.Logf("Expected 2 events for a.com, got %d", len(rs))
+		t.Fail()
+	}
+
+	rs := eh.Query(HistoryFilter{Host: "a.com", Source: "file"})
+	if len(rs) != 1 || rs[0].Id != 3 {
+		t.Logf("Unexpected events for a.com from file %v", rs)
+		t.Fail()
+	}
+}
@@ -1,30 +1,97 @@
 package hipdate
 
 import (
+	"crypto/subtle"
+	"crypto/tls"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/3onyc/hipdate/backends"
+	"github.com/3onyc/hipdate/metrics"
+	"github.com/3onyc/hipdate/shared"
 	"github.com/hydrogen18/stoppableListener"
 	"log"
 	"net"
 	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 )
 
+const (
+	DefaultHttpListen = ":8889"
+
+	sseKeepAlive = 15 * time.Second
+)
+
+var (
+	IncompleteTlsConfigError = errors.New("both http_tls_cert and http_tls_key need to be set")
+)
+
+// HttpServer serves the API, it's configured through the following options:
+//
+//	http_listen    address to listen on, defaults to :8889
+//	http_tls_cert  certificate file, enables TLS together with http_tls_key
+//	http_tls_key   private key file
+//	http_token     bearer token clients need to authenticate with
+//	http_user      basic auth username
+//	http_password  basic auth password
 type HttpServer struct {
-	l *stoppableListener.StoppableListener
-	s *http.Server
-	b backends.Backend
+	l    net.Listener
+	sl   *stoppableListener.StoppableListener
+	s    *http.Server
+	b    backends.Backend
+	mu   sync.RWMutex
+	mux  *http.ServeMux
+	opts shared.OptionMap
+
+	Events  *EventBroker
+	History *EventHistory
+	Health  *Health
+	Drift   *DriftDetector
+
+	DeadLetters *DeadLetterQueue
+	Routes      *RouteSnapshot
 }
 
-func NewHttpServer(b backends.Backend) *HttpServer {
-	return &HttpServer{
-		s: &http.Server{},
-		b: b,
+func NewHttpServer(b backends.Backend, opts shared.OptionMap) (*HttpServer, error) {
+	if opts == nil {
+		opts = shared.OptionMap{}
+	}
+
+	if (opts["http_tls_cert"] == "") != (opts["http_tls_key"] == "") {
+		return nil, IncompleteTlsConfigError
+	}
+
+	h := &HttpServer{
+		s:    &http.Server{},
+		b:    b,
+		mux:  http.NewServeMux(),
+		opts: opts,
 	}
+	h.s.Handler = h
+	h.mux.HandleFunc("/api/v1/status.json", h.status)
+	h.mux.HandleFunc("/api/v1/events", h.events)
+	h.mux.HandleFunc("/api/v1/events/history", h.history)
+	h.mux.HandleFunc("/api/v1/drift", h.drift)
+	h.mux.HandleFunc("/api/v1/deadletter", h.deadLetters)
+	h.mux.HandleFunc("/api/v1/deadletter/replay", h.replayDeadLetters)
+	h.mux.HandleFunc("/metrics", h.metrics)
+	h.mux.HandleFunc("/healthz", h.healthz)
+	h.mux.HandleFunc("/readyz", h.readyz)
+
+	return h, nil
 }
 
-func (h *HttpServer) Start() error {
-	l, err := net.Listen("tcp", ":8889")
+// Listen opens the listening socket, so Addr is known before Serve is called.
+func (h *HttpServer) Listen() error {
+	addr, ok := h.opts["http_listen"]
+	if !ok {
+		addr = DefaultHttpListen
+	}
+
+	l, err := net.Listen("tcp", addr)
 	if err != nil {
 		return err
 	}
@@ -34,28 +101,117 @@ func (h *HttpServer) Start() error {
 		return err
 	}
 
-	http.HandleFunc("/api/v1/status.json", h.status)
-
+	h.sl = sl
 	h.l = sl
+
+	if cert, ok := h.opts["http_tls_cert"]; ok {
+		c, err := tls.LoadX509KeyPair(cert, h.opts["http_tls_key"])
+		if err != nil {
+			sl.Close()
+			return err
+		}
+
+		h.l = tls.NewListener(sl, &tls.Config{Certificates: []tls.Certificate{c}})
+	}
+
+	log.Printf("NOTICE [http] Listening on %s", sl.Addr())
+	return nil
+}
+
+func (h *HttpServer) Serve() {
 	h.s.Serve(h.l)
+}
+
+func (h *HttpServer) Start() error {
+	if err := h.Listen(); err != nil {
+		return err
+	}
 
+	h.Serve()
 	return nil
 }
 
+func (h *HttpServer) Addr() net.Addr {
+	return h.sl.Addr()
+}
+
 func (h *HttpServer) Stop() {
-	h.l.Stop()
+	if h.sl != nil {
+		h.sl.Stop()
+	}
 	log.Println("NOTICE [http] stopped")
 }
 
+// ServeHTTP authenticates the request if authentication is configured, and
+// passes it on to the mux.
+func (h *HttpServer) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	if !h.authorized(req) {
+		if h.opts["http_user"] != "" {
+			rw.Header().Set("WWW-Authenticate", `Basic realm="hipdate"`)
+		}
+		rw.WriteHeader(http.StatusUnauthorized)
+		fmt.Fprintln(rw, "unauthorized")
+		return
+	}
+
+	h.mux.ServeHTTP(rw, req)
+}
+
+func (h *HttpServer) authorized(req *http.Request) bool {
+	token, user := h.opts["http_token"], h.opts["http_user"]
+	if token == "" && user == "" {
+		return true
+	}
+
+	if token != "" {
+		a := req.Header.Get("Authorization")
+		if strings.HasPrefix(a, "Bearer ") && secureCompare(a[7:], token) {
+			return true
+		}
+	}
+
+	if user != "" {
+		u, p, ok := req.BasicAuth()
+		if ok && secureCompare(u, user) && secureCompare(p, h.opts["http_password"]) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func secureCompare(a, b string) bool {
+	return subtle.ConstantTimeCompare([]byte(a), []byte(b)) == 1
+}
+
+// SetBackend replaces the backend, e.g. after a config reload.
+func (h *HttpServer) SetBackend(b backends.Backend) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.b = b
+}
+
+func (h *HttpServer) backend() backends.Backend {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	return h.b
+}
+
 func (h *HttpServer) status(rw http.ResponseWriter, req *http.Request) {
 	rw.Header().Add("Content-Type", "application/json")
-	hs, err := h.b.ListHosts()
+	hs, err := h.backend().ListHosts(req.Context())
 	if err != nil {
 		rw.WriteHeader(500)
 		fmt.Fprint(rw, err)
 		return
 	}
 
+	if h.Routes != nil {
+		h.Routes.Annotate(*hs)
+	}
+
 	b, err := json.MarshalIndent(hs, "", "    ")
 	if err != nil {
 		rw.WriteHeader(500)
@@ -67,3 +223,223 @@ func (h *HttpServer) status(rw http.ResponseWriter, req *http.Request) {
 		log.Println("ERROR [http]", err)
 	}
 }
+
+// history returns the recently processed events, optionally filtered by the
+// host, source and endpoint query parameters.
+func (h *HttpServer) history(rw http.ResponseWriter, req *http.Request) {
+	rw.Header().Add("Content-Type", "application/json")
+	if h.History == nil {
+		rw.WriteHeader(http.StatusNotImplemented)
+		fmt.Fprint(rw, "event history not available")
+		return
+	}
+
+	q := req.URL.Query()
+	rs := h.History.Query(HistoryFilter{
+		Host:     q.Get("host"),
+		Source:   q.Get("source"),
+		Endpoint: q.Get("endpoint"),
+	})
+
+	b, err := json.MarshalIndent(rs, "", "    ")
+	if err != nil {
+		rw.WriteHeader(500)
+		fmt.Fprint(rw, err)
+		return
+	}
+
+	if _, err := rw.Write(b); err != nil {
+		log.Println("ERROR [http]", err)
+	}
+}
+
+// drift returns the report of the last drift check.
+func (h *HttpServer) drift(rw http.ResponseWriter, req *http.Request) {
+	rw.Header().Add("Content-Type", "application/json")
+
+	var dr *DriftReport
+	if h.Drift != nil {
+		dr = h.Drift.Last()
+	}
+
+	if dr == nil {
+		rw.WriteHeader(http.StatusServiceUnavailable)
+		fmt.Fprint(rw, "no drift check has run yet")
+		return
+	}
+
+	b, err := json.MarshalIndent(struct {
+		*DriftReport
+		InSync bool
+	}{dr, dr.InSync()}, "", "    ")
+	if err != nil {
+		rw.WriteHeader(500)
+		fmt.Fprint(rw, err)
+		return
+	}
+
+	if _, err := rw.Write(b); err != nil {
+		log.Println("ERROR [http]", err)
+	}
+}
+
+func (h *HttpServer) deadLetters(rw http.ResponseWriter, req *http.Request) {
+	rw.Header().Add("Content-Type", "application/json")
+	if h.DeadLetters == nil {
+		rw.WriteHeader(http.StatusNotImplemented)
+		fmt.Fprint(rw, "dead letter queue not available")
+		return
+	}
+
+	b, err := json.MarshalIndent(h.DeadLetters.List(), "", "    ")
+	if err != nil {
+		rw.WriteHeader(500)
+		fmt.Fprint(rw, err)
+		return
+	}
+
+	if _, err := rw.Write(b); err != nil {
+		log.Println("ERROR [http]", err)
+	}
+}
+
+// replayDeadLetters hands the dead letter with the id query parameter, or all
+// of them if it's missing, back to the application to be applied again.
+func (h *HttpServer) replayDeadLetters(rw http.ResponseWriter, req *http.Request) {
+	if req.Method != "POST" {
+		rw.Header().Set("Allow", "POST")
+		rw.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	if h.DeadLetters == nil {
+		rw.WriteHeader(http.StatusNotImplemented)
+		fmt.Fprint(rw, "dead letter queue not available")
+		return
+	}
+
+	var id uint64
+	if v := req.URL.Query().Get("id"); v != "" {
+		n, err := strconv.ParseUint(v, 10, 64)
+		if err != nil || n == 0 {
+			rw.WriteHeader(http.StatusBadRequest)
+			fmt.Fprint(rw, "invalid id")
+			return
+		}
+		id = n
+	}
+
+	dls := h.DeadLetters.Take(id)
+	if id != 0 && len(dls) == 0 {
+		rw.WriteHeader(http.StatusNotFound)
+		fmt.Fprint(rw, "dead letter not found")
+		return
+	}
+
+	if len(dls) > 0 {
+		select {
+		case h.DeadLetters.Replays() <- dls:
+		case <-req.Context().Done():
+			h.DeadLetters.Requeue(dls)
+			return
+		}
+	}
+
+	rw.Header().Add("Content-Type", "application/json")
+	fmt.Fprintf(rw, "{\"Replayed\": %d}\n", len(dls))
+}
+
+func (h *HttpServer) metrics(rw http.ResponseWriter, req *http.Request) {
+	rw.Header().Add("Content-Type", "text/plain; version=0.0.4")
+	if err := metrics.Default.Write(rw); err != nil {
+		log.Println("ERROR [http]", err)
+	}
+}
+
+// events streams processed events to the client as Server-Sent Events.
+func (h *HttpServer) events(rw http.ResponseWriter, req *http.Request) {
+	f, ok := rw.(http.Flusher)
+	if !ok || h.Events == nil {
+		rw.WriteHeader(http.StatusNotImplemented)
+		fmt.Fprintln(rw, "event stream not available")
+		return
+	}
+
+	ch := h.Events.Subscribe()
+	defer h.Events.Unsubscribe(ch)
+
+	rw.Header().Set("Content-Type", "text/event-stream")
+	rw.Header().Set("Cache-Control", "no-cache")
+	rw.WriteHeader(200)
+	f.Flush()
+
+	t := time.NewTicker(sseKeepAlive)
+	defer t.Stop()
+
+	for {
+		select {
+		case r, ok := <-ch:
+			if !ok {
+				log.Println("WARN [http] Dropped slow event stream client", req.RemoteAddr)
+				return
+			}
+
+			b, err := json.Marshal(r)
+			if err != nil {
+				log.Println("ERROR [http]", err)
+				continue
+			}
+
+			if _, err := fmt.Fprintf(rw, "id: %d\nevent: change\ndata: %s\n\n", r.Id, b); err != nil {
+				return
+			}
+		case <-t.C:
+			if _, err := fmt.Fprint(rw, ": keepalive\n\n"); err != nil {
+				return
+			}
+		case <-req.Context().Done():
+			return
+		}
+
+		f.Flush()
+	}
+}
+
+func (h *HttpServer) healthz(rw http.ResponseWriter, req *http.Request) {
+	if h.Health != nil && !h.Health.Alive() {
+		rw.WriteHeader(http.StatusServiceUnavailable)
+		fmt.Fprintln(rw, "event loop stalled")
+		return
+	}
+
+	fmt.Fprintln(rw, "ok")
+}
+
+// readyz reports whether the backend is initialised and working, and all
+// sources have finished their initial sync and are connected.
+func (h *HttpServer) readyz(rw http.ResponseWriter, req *http.Request) {
+	rw.Header().Add("Content-Type", "application/json")
+
+	ready, cs := false, map[string]ComponentStatus{}
+	if h.Health != nil {
+		ready, cs = h.Health.Ready()
+	}
+
+	b, err := json.MarshalIndent(struct {
+		Ready      bool
+		Components map[string]ComponentStatus
+	}{ready, cs}, "", "    ")
+	if err != nil {
+		rw.WriteHeader(500)
+		fmt.Fprint(rw, err)
+		return
+	}
+
+	if !ready {
+		rw.WriteHeader(http.StatusServiceUnavailable)
+	}
+
+	if _, err := rw.Write(b); err != nil {
+		log.Println("ERROR [http]", err)
+	}
+}
@@ -0,0 +1,204 @@
+package hipdate
+
+import (
+	"context"
+	"errors"
+	"github.com/3onyc/hipdate/shared"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+type fakeBackend struct {
+	hl shared.HostList
+}
+
+func (fb *fakeBackend) AddEndpoint(ctx context.Context, h shared.Host, e shared.Endpoint) error {
+	fb.hl[h] = append(fb.hl[h], e)
+	return nil
+}
+
+func (fb *fakeBackend) RemoveEndpoint(ctx context.Context, h shared.Host, e shared.Endpoint) error {
+	return nil
+}
+
+func (fb *fakeBackend) ListHosts(ctx context.Context) (*shared.HostList, error) {
+	return &fb.hl, nil
+}
+
+func (fb *fakeBackend) Initialise(ctx context.Context) error {
+	return nil
+}
+
+func newTestServer(t *testing.T, opts shared.OptionMap) *httptest.Server {
+	hs, err := NewHttpServer(&fakeBackend{shared.HostList{}}, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return httptest.NewServer(hs)
+}
+
+func getStatus(t *testing.T, ts *httptest.Server, fn func(*http.Request)) int {
+	req, err := http.NewRequest("GET", ts.URL+"/api/v1/status.json", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fn(req)
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	return resp.StatusCode
+}
+
+func TestHttpServerNoAuth(t *testing.T) {
+	ts := newTestServer(t, nil)
+	defer ts.Close()
+
+	if s := getStatus(t, ts, func(*http.Request) {}); s != 200 {
+		t.Logf("Expected 200, got %d", s)
+		t.Fail()
+	}
+}
+
+func TestHttpServerBearerAuth(t *testing.T) {
+	ts := newTestServer(t, shared.OptionMap{"http_token": "secret"})
+	defer ts.Close()
+
+	if s := getStatus(t, ts, func(*http.Request) {}); s != 401 {
+		t.Logf("Expected 401 without token, got %d", s)
+		t.Fail()
+	}
+
+	s := getStatus(t, ts, func(req *http.Request) {
+		req.Header.Set("Authorization", "Bearer wrong")
+	})
+	if s != 401 {
+		t.Logf("Expected 401 with wrong token, got %d", s)
+		t.Fail()
+	}
+
+	s = getStatus(t, ts, func(req *http.Request) {
+		req.Header.Set("Authorization", "Bearer secret")
+	})
+	if s != 200 {
+		t.Logf("Expected 200 with token, got %d", s)
+		t.Fail()
+	}
+}
+
+func TestHttpServerBasicAuth(t *testing.T) {
+	ts := newTestServer(t, shared.OptionMap{"http_user": "admin", "http_password": "pw"})
+	defer ts.Close()
+
+	s := getStatus(t, ts, func(req *http.Request) {
+		req.SetBasicAuth("admin", "wrong")
+	})
+	if s != 401 {
+		t.Logf("Expected 401 with wrong password, got %d", s)
+		t.Fail()
+	}
+
+	s = getStatus(t, ts, func(req *http.Request) {
+		req.SetBasicAuth("admin", "pw")
+	})
+	if s != 200 {
+		t.Logf("Expected 200 with credentials, got %d", s)
+		t.Fail()
+	}
+}
+
+func TestHttpServerIncompleteTls(t *testing.T) {
+	_, err := NewHttpServer(&fakeBackend{}, shared.OptionMap{"http_tls_cert": "cert.pem"})
+	if err != IncompleteTlsConfigError {
+		t.Fail()
+	}
+}
+
+func TestHttpServerListen(t *testing.T) {
+	hs, err := NewHttpServer(&fakeBackend{shared.HostList{}}, shared.OptionMap{"http_listen": "127.0.0.1:0"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := hs.Listen(); err != nil {
+		t.Fatal(err)
+	}
+	go hs.Serve()
+	defer hs.Stop()
+
+	resp, err := http.Get("http://" + hs.Addr().String() + "/api/v1/status.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != 200 {
+		t.Logf("Expected 200, got %d", resp.StatusCode)
+		t.Fail()
+	}
+}
+
+func TestHttpServerMetrics(t *testing.T) {
+	ts := newTestServer(t, nil)
+	defer ts.Close()
+
+	resp, err := http.Get(ts.URL + "/metrics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	b, _ := ioutil.ReadAll(resp.Body)
+	if resp.StatusCode != 200 || !strings.Contains(string(b), "# TYPE hipdated_hosts gauge") {
+		t.Logf("Unexpected response (%d):\n%s", resp.StatusCode, b)
+		t.Fail()
+	}
+}
+
+func TestHttpServerReplayDeadLetters(t *testing.T) {
+	hs, err := NewHttpServer(&fakeBackend{shared.HostList{}}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hs.DeadLetters = NewDeadLetterQueue(10)
+	hs.DeadLetters.Add(testEvent(), 5, errors.New("boom"))
+	hs.DeadLetters.Add(testEvent(), 5, errors.New("boom"))
+
+	ts := httptest.NewServer(hs)
+	defer ts.Close()
+
+	if resp, err := http.Get(ts.URL + "/api/v1/deadletter/replay"); err != nil {
+		t.Fatal(err)
+	} else if resp.Body.Close(); resp.StatusCode != http.StatusMethodNotAllowed {
+		t.Logf("Expected 405 for GET, got %d", resp.StatusCode)
+		t.Fail()
+	}
+
+	replayed := make(chan []*DeadLetter, 1)
+	go func() {
+		replayed <- <-hs.DeadLetters.Replays()
+	}()
+
+	resp, err := http.Post(ts.URL+"/api/v1/deadletter/replay?id=2", "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	if dls := <-replayed; resp.StatusCode != 200 || len(dls) != 1 || dls[0].Id != 2 {
+		t.Logf("Unexpected replay of id 2: %d %v", resp.StatusCode, dls)
+		t.Fail()
+	}
+
+	if hs.DeadLetters.Len() != 1 {
+		t.Logf("Expected 1 dead letter left, got %d", hs.DeadLetters.Len())
+		t.Fail()
+	}
+}
@@ -6,4 +6,6 @@ import (
 
 	_ "github.com/3onyc/hipdate/sources/docker"
 	_ "github.com/3onyc/hipdate/sources/file"
+	_ "github.com/3onyc/hipdate/sources/kubernetes"
+	_ "github.com/3onyc/hipdate/sources/static"
 )
@@ -0,0 +1,350 @@
+// Package metrics keeps track of hipdated's counters, gauges and latencies,
+// and renders them in the Prometheus text exposition format.
+package metrics
+
+import (
+	"fmt"
+	"github.com/codahale/hdrhistogram"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	Default = NewRegistry()
+
+	EventsReceived = Default.NewCounter(
+		"hipdated_events_received_total",
+		"Change events received from sources.",
+		"source", "type",
+	)
+	BackendOperations = Default.NewCounter(
+		"hipdated_backend_operations_total",
+		"Operations performed on the backend.",
+		"backend", "operation",
+	)
+	BackendErrors = Default.NewCounter(
+		"hipdated_backend_errors_total",
+		"Backend operations that failed.",
+		"backend", "operation",
+	)
+	BackendLatency = Default.NewSummary(
+		"hipdated_backend_operation_duration_seconds",
+		"Latency of backend operations.",
+		"backend", "operation",
+	)
+	BackendRetries = Default.NewCounter(
+		"hipdated_backend_retries_total",
+		"Retries of failed backend operations.",
+		"backend", "operation",
+	)
+	DeadLetters = Default.NewGauge(
+		"hipdated_dead_letters",
+		"Events in the dead letter queue.",
+	)
+	LastChange = Default.NewGauge(
+		"hipdated_last_change_timestamp_seconds",
+		"Unix time of the last change applied to the backend.",
+	)
+	Hosts = Default.NewGauge(
+		"hipdated_hosts",
+		"Hosts currently routed.",
+	)
+	Endpoints = Default.NewGauge(
+		"hipdated_endpoints",
+		"Endpoints currently routed, summed over all hosts.",
+	)
+	UnhealthyEndpoints = Default.NewGauge(
+		"hipdated_unhealthy_endpoints",
+		"Endpoints kept out of the backend by a failing health check.",
+	)
+	Drift = Default.NewGauge(
+		"hipdated_drift_endpoints",
+		"Endpoints differing between hipdated and the backend at the last check.",
+		"kind",
+	)
+	DockerReconnects = Default.NewCounter(
+		"hipdated_docker_reconnects_total",
+		"Times the docker source reconnected to the docker daemon.",
+	)
+)
+
+type Metric interface {
+	Write(w io.Writer) error
+}
+
+type Registry struct {
+	mu      sync.Mutex
+	metrics []Metric
+}
+
+func NewRegistry() *Registry {
+	return &Registry{}
+}
+
+func (r *Registry) Register(m Metric) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.metrics = append(r.metrics, m)
+}
+
+// Write writes all registered metrics, in order of registration.
+func (r *Registry) Write(w io.Writer) error {
+	r.mu.Lock()
+	ms := append([]Metric{}, r.metrics...)
+	r.mu.Unlock()
+
+	for _, m := range ms {
+		if err := m.Write(w); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (r *Registry) NewCounter(name, help string, labels ...string) *Counter {
+	c := &Counter{vec: newVec(name, help, "counter", labels)}
+	r.Register(c)
+	return c
+}
+
+func (r *Registry) NewGauge(name, help string, labels ...string) *Gauge {
+	g := &Gauge{vec: newVec(name, help, "gauge", labels)}
+	r.Register(g)
+	return g
+}
+
+func (r *Registry) NewSummary(name, help string, labels ...string) *Summary {
+	s := &Summary{vec: newVec(name, help, "summary", labels)}
+	r.Register(s)
+	return s
+}
+
+// vec holds the values of a metric for every combination of label values.
+type vec struct {
+	name   string
+	help   string
+	typ    string
+	labels []string
+	mu     sync.Mutex
+	values map[string]*value
+}
+
+type value struct {
+	labels []string
+	v      float64
+	h      *hdrhistogram.Histogram
+	sum    float64
+	count  int64
+}
+
+func newVec(name, help, typ string, labels []string) vec {
+	return vec{
+		name:   name,
+		help:   help,
+		typ:    typ,
+		labels: labels,
+		values: map[string]*value{},
+	}
+}
+
+// with returns the value for the given label values, the caller has to hold
+// the lock.
+func (v *vec) with(lvs []string) *value {
+	if len(lvs) != len(v.labels) {
+		panic(fmt.Sprintf("metrics: %s expects %d label values, got %d", v.name, len(v.labels), len(lvs)))
+	}
+
+	k := strings.Join(lvs, "\xff")
+	val, ok := v.values[k]
+	if !ok {
+		val = &value{labels: append([]string{}, lvs...)}
+		v.values[k] = val
+	}
+
+	return val
+}
+
+func (v *vec) get(lvs []string) float64 {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	return v.with(lvs).v
+}
+
+func (v *vec) writeHeader(w io.Writer) error {
+	_, err := fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", v.name, v.help, v.name, v.typ)
+	return err
+}
+
+// sorted returns the values ordered by their label values, the caller has to
+// hold the lock.
+func (v *vec) sorted() []*value {
+	ks := []string{}
+	for k := range v.values {
+		ks = append(ks, k)
+	}
+	sort.Strings(ks)
+
+	vals := []*value{}
+	for _, k := range ks {
+		vals = append(vals, v.values[k])
+	}
+
+	return vals
+}
+
+func (v *vec) writeSimple(w io.Writer) error {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	if err := v.writeHeader(w); err != nil {
+		return err
+	}
+
+	if len(v.labels) == 0 {
+		v.with(nil)
+	}
+
+	for _, val := range v.sorted() {
+		if err := writeSample(w, v.name, v.labels, val.labels, val.v); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+type Counter struct {
+	vec
+}
+
+func (c *Counter) Add(f float64, lvs ...string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.with(lvs).v += f
+}
+
+func (c *Counter) Inc(lvs ...string) {
+	c.Add(1, lvs...)
+}
+
+func (c *Counter) Value(lvs ...string) float64 {
+	return c.get(lvs)
+}
+
+func (c *Counter) Write(w io.Writer) error {
+	return c.writeSimple(w)
+}
+
+type Gauge struct {
+	vec
+}
+
+func (g *Gauge) Set(f float64, lvs ...string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	g.with(lvs).v = f
+}
+
+func (g *Gauge) Value(lvs ...string) float64 {
+	return g.get(lvs)
+}
+
+func (g *Gauge) Write(w io.Writer) error {
+	return g.writeSimple(w)
+}
+
+var (
+	// SummaryQuantiles are the quantiles reported for every summary.
+	SummaryQuantiles = []float64{0.5, 0.9, 0.99}
+)
+
+// Summary records durations in an HDR histogram with microsecond precision,
+// tracking values up to a minute.
+type Summary struct {
+	vec
+}
+
+func (s *Summary) Observe(d time.Duration, lvs ...string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	val := s.with(lvs)
+	if val.h == nil {
+		val.h = hdrhistogram.New(1, int64(time.Minute/time.Microsecond), 3)
+	}
+
+	us := int64(d / time.Microsecond)
+	if us < 1 {
+		us = 1
+	}
+	val.h.RecordValue(us)
+	val.sum += d.Seconds()
+	val.count++
+}
+
+func (s *Summary) Count(lvs ...string) int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.with(lvs).count
+}
+
+func (s *Summary) Write(w io.Writer) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.writeHeader(w); err != nil {
+		return err
+	}
+
+	ls := append(append([]string{}, s.labels...), "quantile")
+	for _, val := range s.sorted() {
+		if val.h == nil {
+			continue
+		}
+
+		for _, q := range SummaryQuantiles {
+			lvs := append(append([]string{}, val.labels...), strconv.FormatFloat(q, 'g', -1, 64))
+			us := val.h.ValueAtQuantile(q * 100)
+			if err := writeSample(w, s.name, ls, lvs, float64(us)/1e6); err != nil {
+				return err
+			}
+		}
+
+		if err := writeSample(w, s.name+"_sum", s.labels, val.labels, val.sum); err != nil {
+			return err
+		}
+
+		if err := writeSample(w, s.name+"_count", s.labels, val.labels, float64(val.count)); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func writeSample(w io.Writer, name string, ls, lvs []string, v float64) error {
+	pairs := []string{}
+	for i, l := range ls {
+		pairs = append(pairs, l+`="`+labelEscaper.Replace(lvs[i])+`"`)
+	}
+
+	labels := ""
+	if len(pairs) > 0 {
+		labels = "{" + strings.Join(pairs, ",") + "}"
+	}
+
+	_, err := fmt.Fprintf(w, "%s%s %s\n", name, labels, strconv.FormatFloat(v, 'g', -1, 64))
+	return err
+}
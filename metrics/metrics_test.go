@@ -0,0 +1,74 @@
+package metrics
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCounterOutput(t *testing.T) {
+	r := NewRegistry()
+	c := r.NewCounter("test_events_total", "Events.", "source", "type")
+	c.Inc("docker", "add")
+	c.Inc("docker", "add")
+	c.Inc("file", "re\"move")
+
+	buf := &bytes.Buffer{}
+	if err := r.Write(buf); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := `# HELP test_events_total Events.
+# TYPE test_events_total counter
+test_events_total{source="docker",type="add"} 2
+test_events_total{source="file",type="re\"move"} 1
+`
+	if buf.String() != expected {
+		t.Logf("Unexpected output:\n%s", buf.String())
+		t.Fail()
+	}
+}
+
+func TestGaugeWithoutLabels(t *testing.T) {
+	r := NewRegistry()
+	g := r.NewGauge("test_hosts", "Hosts.")
+
+	buf := &bytes.Buffer{}
+	r.Write(buf)
+	if !strings.Contains(buf.String(), "\ntest_hosts 0\n") {
+		t.Logf("Unset gauge not written as 0:\n%s", buf.String())
+		t.Fail()
+	}
+
+	g.Set(3)
+	buf.Reset()
+	r.Write(buf)
+	if !strings.Contains(buf.String(), "\ntest_hosts 3\n") {
+		t.Logf("Gauge value not written:\n%s", buf.String())
+		t.Fail()
+	}
+}
+
+func TestSummaryOutput(t *testing.T) {
+	r := NewRegistry()
+	s := r.NewSummary("test_duration_seconds", "Durations.", "operation")
+	for i := 1; i <= 100; i++ {
+		s.Observe(time.Duration(i)*time.Millisecond, "add")
+	}
+
+	buf := &bytes.Buffer{}
+	r.Write(buf)
+	out := buf.String()
+
+	for _, l := range []string{
+		`test_duration_seconds{operation="add",quantile="0.5"} 0.05`,
+		`test_duration_seconds{operation="add",quantile="0.99"} 0.099`,
+		`test_duration_seconds_count{operation="add"} 100`,
+	} {
+		if !strings.Contains(out, l) {
+			t.Logf("Missing line '%s' in:\n%s", l, out)
+			t.Fail()
+		}
+	}
+}
@@ -3,14 +3,46 @@ package shared
 import (
 	"bytes"
 	"errors"
-	"fmt"
 	"hash/crc32"
+	"net"
 	"net/url"
+	"sort"
 	"strconv"
 	"strings"
+	"time"
 )
 
+var (
+	InvalidWeightError      = errors.New("weight must be a positive number")
+	UnknownEventKindError   = errors.New("unknown event kind")
+	InvalidHealthCheckError = errors.New("invalid health check setting")
+	InvalidTagError         = errors.New("tags can't contain commas, repeat tags= for several")
+)
+
+// MaxWeight is the highest weight an endpoint can have, higher ones are
+// capped, since backends like hipache list an endpoint once per unit of
+// weight.
+const MaxWeight = 100
+
+// HealthCheckSettings are the names of the settings of a health check.
+var HealthCheckSettings = []string{"path", "status", "interval", "rise", "fall"}
+
 type OptionMap map[string]string
+
+func (om OptionMap) Equal(o OptionMap) bool {
+	if len(om) != len(o) {
+		return false
+	}
+
+	for k, v := range om {
+		if v2, ok := o[k]; !ok || v != v2 {
+			return false
+		}
+	}
+
+	return true
+}
+
 type HostList map[Host][]Endpoint
 
 func (hl HostList) Pprint() string {
@@ -29,28 +61,215 @@ func (hl HostList) Pprint() string {
 	return buf.String()
 }
 
+type EventKind int
+
+const (
+	EventAdd EventKind = iota + 1
+	EventRemove
+	EventBatch
+	EventDrain
+)
+
+var eventKinds = map[EventKind]string{
+	EventAdd:    "add",
+	EventRemove: "remove",
+	EventBatch:  "batch",
+	EventDrain:  "drain",
+}
+
+func ParseEventKind(s string) (EventKind, error) {
+	for k, n := range eventKinds {
+		if n == s {
+			return k, nil
+		}
+	}
+
+	return 0, UnknownEventKindError
+}
+
+func (k EventKind) String() string {
+	if n, ok := eventKinds[k]; ok {
+		return n
+	}
+
+	return "unknown"
+}
+
+func (k EventKind) MarshalText() ([]byte, error) {
+	return []byte(k.String()), nil
+}
+
+func (k *EventKind) UnmarshalText(b []byte) error {
+	pk, err := ParseEventKind(string(b))
+	if err != nil {
+		return err
+	}
+
+	*k = pk
+	return nil
+}
+
+// ChangeEvent adds or removes an endpoint of a host, or drains it ahead of a
+// planned removal, or for batches applies Events as one unit. Time is set
+// when the event is created, Source and Seq when the application receives
+// it, Seq increasing with every event.
 type ChangeEvent struct {
-	Type     string
-	Host     Host
+	Type     EventKind
+	Host     Host `json:",omitempty"`
 	Endpoint Endpoint
+	Events   []*ChangeEvent `json:",omitempty"`
+	Source   string
+	Seq      uint64
+	Time     time.Time
 }
 
-func NewChangeEvent(t string, h Host, e Endpoint) *ChangeEvent {
+func NewChangeEvent(k EventKind, h Host, e Endpoint) *ChangeEvent {
 	return &ChangeEvent{
-		Type:     t,
+		Type:     k,
 		Host:     h,
 		Endpoint: e,
+		Time:     time.Now(),
 	}
 }
 
+// NewBatchEvent groups events, like the initial sync of a source, so they're
+// applied together.
+func NewBatchEvent(evs []*ChangeEvent) *ChangeEvent {
+	return &ChangeEvent{
+		Type:   EventBatch,
+		Events: evs,
+		Time:   time.Now(),
+	}
+}
+
+// Endpoint is an URL requests are routed to, with optional metadata. Weight
+// is relative to the other endpoints of a host, 0 meaning the default of 1.
+// Tags is a sorted, comma separated list so endpoints stay comparable.
 type Endpoint struct {
 	Scheme  string
 	Address string
 	Port    uint32
+	Weight  int    `json:",omitempty"`
+	Tags    string `json:",omitempty"`
+	Check   HealthCheck
+	Origin  Origin
+}
+
+// HealthCheck is how an endpoint is probed, the request for Path has to be
+// answered with Status, any 2xx or 3xx status if it's 0. Endpoints are taken
+// out after Fall failed checks in a row, and put back after Rise passed ones.
+// Endpoints without a path aren't checked, other zero values mean the defaults.
+type HealthCheck struct {
+	Path     string        `json:",omitempty"`
+	Status   int           `json:",omitempty"`
+	Interval time.Duration `json:",omitempty"`
+	Rise     int           `json:",omitempty"`
+	Fall     int           `json:",omitempty"`
+}
+
+func (hc HealthCheck) Enabled() bool {
+	return hc.Path != ""
 }
 
+// Set sets one of the HealthCheckSettings from its string form.
+func (hc *HealthCheck) Set(k, v string) error {
+	if k == "path" {
+		hc.Path = "/" + strings.TrimLeft(v, "/")
+		return nil
+	}
+
+	if k == "interval" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 {
+			return InvalidHealthCheckError
+		}
+		hc.Interval = d
+		return nil
+	}
+
+	n, err := strconv.Atoi(v)
+	if err != nil || n < 1 {
+		return InvalidHealthCheckError
+	}
+
+	switch k {
+	case "status":
+		hc.Status = n
+	case "rise":
+		hc.Rise = n
+	case "fall":
+		hc.Fall = n
+	default:
+		return InvalidHealthCheckError
+	}
+
+	return nil
+}
+
+// Origin is where an endpoint came from, the source and an identifier like
+// a container id within the source.
+type Origin struct {
+	Source string `json:",omitempty"`
+	Id     string `json:",omitempty"`
+}
+
+// Bare returns the endpoint without its metadata, identifying it.
+func (e Endpoint) Bare() Endpoint {
+	return Endpoint{Scheme: e.Scheme, Address: e.Address, Port: e.Port}
+}
+
+// EffectiveWeight returns the weight, defaulting to 1 and capped at
+// MaxWeight.
+func (e Endpoint) EffectiveWeight() int {
+	switch {
+	case e.Weight < 1:
+		return 1
+	case e.Weight > MaxWeight:
+		return MaxWeight
+	}
+
+	return e.Weight
+}
+
+// ParseWeight parses a weight, capping it at MaxWeight.
+func ParseWeight(s string) (int, error) {
+	n, err := strconv.Atoi(s)
+	if err != nil || n < 1 {
+		return 0, InvalidWeightError
+	}
+
+	if n > MaxWeight {
+		return MaxWeight, nil
+	}
+
+	return n, nil
+}
+
+func (e Endpoint) TagList() []string {
+	if e.Tags == "" {
+		return []string{}
+	}
+
+	return strings.Split(e.Tags, ",")
+}
+
+// JoinTags returns tags in the form used by Endpoint.Tags.
+func JoinTags(tags []string) string {
+	ts := []string{}
+	for _, t := range tags {
+		if t = strings.TrimSpace(t); t != "" {
+			ts = append(ts, t)
+		}
+	}
+	sort.Strings(ts)
+
+	return strings.Join(ts, ",")
+}
+
+// String returns the endpoint as an URL, IPv6 addresses are enclosed in
+// brackets.
 func (e *Endpoint) String() string {
-	return fmt.Sprintf("%s://%s:%d", e.Scheme, e.Address, e.Port)
+	return e.Scheme + "://" + net.JoinHostPort(e.Address, strconv.FormatUint(uint64(e.Port), 10))
 }
 
 func (e *Endpoint) Hash() string {
@@ -60,7 +279,7 @@ func (e *Endpoint) Hash() string {
 func NewEndpoint(s, a string, p uint32) *Endpoint {
 	return &Endpoint{
 		Scheme:  s,
-		Address: a,
+		Address: strings.Trim(a, "[]"),
 		Port:    p,
 	}
 }
@@ -71,19 +290,93 @@ func NewEndpointFromUrl(us string) (*Endpoint, error) {
 		return nil, err
 	}
 
-	if !strings.Contains(u.Host, ":") {
+	if u.Port() == "" {
 		return nil, errors.New("Missing port in URL")
 	}
 
-	s := strings.SplitN(u.Host, ":", 2)
-	p, err := strconv.ParseUint(s[1], 10, 32)
+	p, err := strconv.ParseUint(u.Port(), 10, 32)
 	if err != nil {
 		return nil, err
 	}
 
-	return NewEndpoint(u.Scheme, s[0], uint32(p)), nil
+	e := NewEndpoint(u.Scheme, u.Hostname(), uint32(p))
+	if err := e.setMetadata(u.Query()); err != nil {
+		return nil, err
+	}
+
+	return e, nil
+}
+
+// setMetadata sets the weight, tags and health check from URL query
+// parameters, like http://10.0.0.1:80?weight=2&tags=canary&tags=eu&health_path=/ping
+// Tags are repeated rather than comma separated, commas separate the URLs of
+// the static source.
+func (e *Endpoint) setMetadata(q url.Values) error {
+	if w := q.Get("weight"); w != "" {
+		n, err := ParseWeight(w)
+		if err != nil {
+			return err
+		}
+		e.Weight = n
+	}
+
+	for _, t := range q["tags"] {
+		if strings.Contains(t, ",") {
+			return InvalidTagError
+		}
+	}
+	e.Tags = JoinTags(q["tags"])
+
+	for _, k := range HealthCheckSettings {
+		if v := q.Get("health_" + k); v != "" {
+			if err := e.Check.Set(k, v); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
 }
 
 type ContainerID string
 
+// Host is a hostname, optionally followed by a path prefix like
+// example.com/api, in which case only the requests for the host with a path
+// starting with the prefix are routed to its endpoints.
 type Host string
+
+func NewHost(name, path string) Host {
+	path = strings.Trim(path, "/")
+	if path == "" {
+		return Host(name)
+	}
+
+	return Host(name + "/" + path)
+}
+
+// ParseHost parses a hostname with an optional path, normalising the path.
+func ParseHost(s string) Host {
+	i := strings.Index(s, "/")
+	if i < 0 {
+		return Host(s)
+	}
+
+	return NewHost(s[:i], s[i:])
+}
+
+func (h Host) Name() string {
+	if i := strings.Index(string(h), "/"); i >= 0 {
+		return string(h)[:i]
+	}
+
+	return string(h)
+}
+
+// Path returns the path prefix, or "" if all paths are routed.
+func (h Host) Path() string {
+	if i := strings.Index(string(h), "/"); i >= 0 {
+		return string(h)[i:]
+	}
+
+	return ""
+}
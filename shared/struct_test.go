@@ -0,0 +1,145 @@
+package shared
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func TestParseHost(t *testing.T) {
+	expected := map[string]Host{
+		"example.com":          "example.com",
+		"example.com/":         "example.com",
+		"example.com/api":      "example.com/api",
+		"example.com/api/":     "example.com/api",
+		"example.com//api/v1/": "example.com/api/v1",
+	}
+
+	for s, e := range expected {
+		if h := ParseHost(s); h != e {
+			t.Logf("Expected '%s' to parse as '%s', got '%s'", s, e, h)
+			t.Fail()
+		}
+	}
+}
+
+func TestHostNameAndPath(t *testing.T) {
+	h := NewHost("example.com", "/api/")
+	if h.Name() != "example.com" || h.Path() != "/api" {
+		t.Logf("Unexpected name '%s' and path '%s'", h.Name(), h.Path())
+		t.Fail()
+	}
+
+	h = NewHost("example.com", "/")
+	if h.Name() != "example.com" || h.Path() != "" {
+		t.Logf("Unexpected name '%s' and path '%s'", h.Name(), h.Path())
+		t.Fail()
+	}
+}
+
+func TestEndpointIPv6(t *testing.T) {
+	e, err := NewEndpointFromUrl("http://[fd00::1]:8080")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if e.Address != "fd00::1" || e.Port != 8080 {
+		t.Logf("Unexpected endpoint %+v", e)
+		t.Fail()
+	}
+
+	if s := e.String(); s != "http://[fd00::1]:8080" {
+		t.Logf("Expected http://[fd00::1]:8080, got %s", s)
+		t.Fail()
+	}
+
+	if s := NewEndpoint("http", "[fd00::2]", 80).String(); s != "http://[fd00::2]:80" {
+		t.Logf("Expected http://[fd00::2]:80, got %s", s)
+		t.Fail()
+	}
+
+	if _, err := NewEndpointFromUrl("http://[fd00::1]"); err == nil {
+		t.Log("Expected missing port error")
+		t.Fail()
+	}
+}
+
+func TestNewEndpointFromUrlMetadata(t *testing.T) {
+	e, err := NewEndpointFromUrl("http://10.0.0.1:8080?weight=3&tags=eu&tags=canary&tags=web")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if e.String() != "http://10.0.0.1:8080" || e.Weight != 3 || e.Tags != "canary,eu,web" {
+		t.Logf("Unexpected endpoint %+v", e)
+		t.Fail()
+	}
+
+	if e.Bare() != *NewEndpoint("http", "10.0.0.1", 8080) {
+		t.Logf("Unexpected bare endpoint %+v", e.Bare())
+		t.Fail()
+	}
+
+	if _, err := NewEndpointFromUrl("http://10.0.0.1:8080?tags=eu,canary"); err != InvalidTagError {
+		t.Logf("Expected InvalidTagError, got %v", err)
+		t.Fail()
+	}
+
+	if _, err := NewEndpointFromUrl("http://10.0.0.1:8080?weight=0"); err != InvalidWeightError {
+		t.Logf("Expected InvalidWeightError, got %v", err)
+		t.Fail()
+	}
+
+	if e, _ := NewEndpointFromUrl("http://10.0.0.1:8080?weight=100000"); e == nil || e.Weight != MaxWeight {
+		t.Logf("Expected the weight to be capped at %d, got %+v", MaxWeight, e)
+		t.Fail()
+	}
+
+	if w := (Endpoint{Weight: 100000}).EffectiveWeight(); w != MaxWeight {
+		t.Logf("Expected the effective weight to be capped at %d, got %d", MaxWeight, w)
+		t.Fail()
+	}
+}
+
+func TestNewEndpointFromUrlHealthCheck(t *testing.T) {
+	e, err := NewEndpointFromUrl("http://10.0.0.1:8080?health_path=ping&health_interval=5s&health_fall=2")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := HealthCheck{Path: "/ping", Interval: 5 * time.Second, Fall: 2}
+	if e.Check != expected || !e.Check.Enabled() {
+		t.Logf("Unexpected health check %+v", e.Check)
+		t.Fail()
+	}
+
+	if e.Bare().Check.Enabled() {
+		t.Logf("Bare endpoint has a health check %+v", e.Bare())
+		t.Fail()
+	}
+
+	for _, q := range []string{"health_status=ok", "health_rise=0", "health_interval=-1s"} {
+		if _, err := NewEndpointFromUrl("http://10.0.0.1:8080?" + q); err != InvalidHealthCheckError {
+			t.Logf("Expected InvalidHealthCheckError for %s, got %v", q, err)
+			t.Fail()
+		}
+	}
+}
+
+func TestEventKindJSON(t *testing.T) {
+	b, err := json.Marshal(NewChangeEvent(EventRemove, "example.com", *NewEndpoint("http", "10.0.0.1", 80)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var ce ChangeEvent
+	if err := json.Unmarshal(b, &ce); err != nil || ce.Type != EventRemove {
+		t.Logf("Expected a remove event from %s, got %s (%v)", b, ce.Type, err)
+		t.Fail()
+	}
+
+	if _, err := ParseEventKind("update"); err != UnknownEventKindError {
+		t.Logf("Expected UnknownEventKindError, got %v", err)
+		t.Fail()
+	}
+}
@@ -0,0 +1,61 @@
+package hipdate
+
+import (
+	"github.com/3onyc/hipdate/shared"
+	"sync"
+)
+
+// RouteSnapshot holds the latest copy of the routes, with the metadata the
+// sources announced, so the API can read them outside the event loop.
+type RouteSnapshot struct {
+	mu sync.RWMutex
+	hl shared.HostList
+}
+
+func NewRouteSnapshot() *RouteSnapshot {
+	return &RouteSnapshot{hl: shared.HostList{}}
+}
+
+func (rs *RouteSnapshot) Set(hl shared.HostList) {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+
+	rs.hl = hl
+}
+
+func (rs *RouteSnapshot) Get() shared.HostList {
+	rs.mu.RLock()
+	defer rs.mu.RUnlock()
+
+	return rs.hl
+}
+
+// Annotate adds the metadata of the known routes to the endpoints in hl that
+// the backend didn't keep it for.
+func (rs *RouteSnapshot) Annotate(hl shared.HostList) {
+	known := rs.Get()
+
+	for h, eps := range hl {
+		for i, e := range eps {
+			for _, k := range known[h] {
+				if k.Bare() != e.Bare() {
+					continue
+				}
+
+				if e.Weight == 0 {
+					e.Weight = k.Weight
+				}
+				if e.Tags == "" {
+					e.Tags = k.Tags
+				}
+				if !e.Check.Enabled() {
+					e.Check = k.Check
+				}
+				if e.Origin == (shared.Origin{}) {
+					e.Origin = k.Origin
+				}
+				eps[i] = e
+			}
+		}
+	}
+}
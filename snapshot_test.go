@@ -0,0 +1,29 @@
+package hipdate
+
+import (
+	"github.com/3onyc/hipdate/shared"
+	"testing"
+)
+
+func TestRouteSnapshotAnnotate(t *testing.T) {
+	e := *shared.NewEndpoint("http", "10.0.0.1", 80)
+	known := e
+	known.Weight, known.Tags = 2, "canary"
+	known.Origin = shared.Origin{Source: "docker", Id: "abc"}
+
+	rs := NewRouteSnapshot()
+	rs.Set(shared.HostList{"a.com": {known}})
+
+	hl := shared.HostList{"a.com": {e}, "b.com": {e}}
+	rs.Annotate(hl)
+
+	if hl["a.com"][0] != known {
+		t.Logf("Expected %+v, got %+v", known, hl["a.com"][0])
+		t.Fail()
+	}
+
+	if hl["b.com"][0] != e {
+		t.Logf("Unknown route annotated %+v", hl["b.com"][0])
+		t.Fail()
+	}
+}
@@ -1,16 +1,28 @@
 package docker
 
 import (
+	"context"
 	"errors"
+	"github.com/3onyc/hipdate/metrics"
 	"github.com/3onyc/hipdate/shared"
 	"github.com/3onyc/hipdate/sources"
 	docker "github.com/fsouza/go-dockerclient"
 	"log"
-	"sync"
+	"time"
 )
 
 var (
 	MissingDockerUrlError = errors.New("docker url not specified")
+	LostConnectionError   = errors.New("lost connection to docker")
+)
+
+const (
+	maxReconnectDelay = time.Minute
+
+	// DefaultKillTimeout is how long a container can keep running after a
+	// signal before its drained routes are added again, docker stop waits as
+	// long before killing it.
+	DefaultKillTimeout = 10 * time.Second
 )
 
 type ContainerMap map[shared.ContainerID]*ContainerData
@@ -19,12 +31,16 @@ type ContainerData struct {
 	Hostnames []shared.Host
 }
 type DockerSource struct {
+	*sources.StatusTracker
 	d          *docker.Client
+	api        *apiClient
 	cde        chan *docker.APIEvents
 	cce        chan *shared.ChangeEvent
+	kc         chan shared.ContainerID
 	Containers ContainerMap
-	wg         *sync.WaitGroup
-	sc         chan bool
+	preferIPv6 bool
+	drainKill  bool
+	killTime   time.Duration
 }
 
 func NewContainerData(e shared.Endpoint, h []shared.Host) *ContainerData {
@@ -34,25 +50,53 @@ func NewContainerData(e shared.Endpoint, h []shared.Host) *ContainerData {
 	}
 }
 
-func (ds *DockerSource) eventHandler(cde chan *docker.APIEvents) {
+func (ds *DockerSource) eventHandler(ctx context.Context) {
 	for {
 		select {
-		case e := <-cde:
+		case e, ok := <-ds.cde:
+			if !ok || e == docker.EOFEvent {
+				if !ds.reconnect(ctx) {
+					return
+				}
+				continue
+			}
+
 			log.Printf("DEBUG [source:docker] received (%s) %s", e.Status, e.ID)
-			if err := ds.handleEvent(e); err != nil {
+			if err := ds.handleEvent(ctx, e); err != nil {
 				log.Println(err)
 			}
-		case <-ds.sc:
-			ds.Stop()
+		case cId := <-ds.kc:
+			if err := ds.handleKilled(cId); err != nil {
+				log.Println("ERROR [source:docker]", err)
+			}
+		case <-ctx.Done():
 			return
 		}
 	}
 }
 
-func (ds *DockerSource) handleEvent(e *docker.APIEvents) error {
+func (ds *DockerSource) handleEvent(ctx context.Context, e *docker.APIEvents) error {
 	cId := shared.ContainerID(e.ID)
+	// A stopping container is sent a signal first, with drain_on_kill its
+	// routes are drained until it's gone. The kill event doesn't say which
+	// signal was sent, so one that doesn't stop it, like docker kill -s HUP,
+	// takes it out of rotation until it's found running after the kill
+	// timeout. Without it, routes are only removed once the container died,
+	// and requests sent while it shuts down can fail.
 	switch e.Status {
-	case "die", "stop", "kill":
+	case "kill":
+		if !ds.drainKill {
+			break
+		}
+
+		ds.handleDrain(cId)
+		time.AfterFunc(ds.killTime, func() {
+			select {
+			case ds.kc <- cId:
+			case <-ctx.Done():
+			}
+		})
+	case "die", "stop":
 		ds.handleRemove(cId)
 	case "start", "restart":
 		ds.handleAdd(cId)
@@ -64,8 +108,6 @@ func (ds *DockerSource) handleEvent(e *docker.APIEvents) error {
 func NewDockerSource(
 	opt shared.OptionMap,
 	cce chan *shared.ChangeEvent,
-	wg *sync.WaitGroup,
-	sc chan bool,
 ) (
 	sources.Source,
 	error,
@@ -84,60 +126,230 @@ func NewDockerSource(
 		return nil, err
 	}
 
+	api, err := newAPIClient(du)
+	if err != nil {
+		return nil, err
+	}
+
+	kt := DefaultKillTimeout
+	if v, ok := opt["kill_timeout"]; ok {
+		if kt, err = time.ParseDuration(v); err != nil {
+			return nil, err
+		}
+	}
+
 	return &DockerSource{
-		d:          d,
-		cce:        cce,
-		cde:        make(chan *docker.APIEvents),
-		Containers: ContainerMap{},
-		wg:         wg,
-		sc:         sc,
+		StatusTracker: sources.NewStatusTracker(),
+		d:             d,
+		api:           api,
+		cce:           cce,
+		cde:           make(chan *docker.APIEvents),
+		kc:            make(chan shared.ContainerID),
+		Containers:    ContainerMap{},
+		preferIPv6:    opt["prefer_ipv6"] == "true",
+		drainKill:     opt["drain_on_kill"] == "true",
+		killTime:      kt,
 	}, nil
 }
 
-func (ds *DockerSource) Start() {
-	defer ds.wg.Done()
-	ds.wg.Add(1)
-
-	ds.Initialise()
+func (ds *DockerSource) Start(ctx context.Context) error {
+	if err := ds.Initialise(); err != nil {
+		log.Println("ERROR [source:docker]", err)
+		ds.SetError(err)
+	} else {
+		ds.SetSynced()
+	}
 
 	log.Println("NOTICE [source:docker] Starting...")
 
-	ds.d.AddEventListener(ds.cde)
-	ds.eventHandler(ds.cde)
-}
+	if err := ds.d.AddEventListener(ds.cde); err != nil {
+		ds.SetError(err)
+		return err
+	}
+	ds.eventHandler(ctx)
 
-func (ds DockerSource) Stop() {
 	ds.d.RemoveEventListener(ds.cde)
 	log.Println("NOTICE [source:docker] Stopped")
+	return nil
+}
+
+// reconnect waits for the docker daemon to come back after the event stream
+// was lost, and resyncs the containers once it has. It returns false if the
+// source was stopped in the meantime.
+func (ds *DockerSource) reconnect(ctx context.Context) bool {
+	log.Println("WARN [source:docker] Lost connection to docker, reconnecting...")
+	ds.SetError(LostConnectionError)
+
+	for delay := time.Second; ; delay *= 2 {
+		if delay > maxReconnectDelay {
+			delay = maxReconnectDelay
+		}
+
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return false
+		}
+
+		if err := ds.d.Ping(); err != nil {
+			log.Println("WARN [source:docker]", err)
+			continue
+		}
+
+		ds.cde = make(chan *docker.APIEvents)
+		if err := ds.d.AddEventListener(ds.cde); err != nil {
+			log.Println("WARN [source:docker]", err)
+			continue
+		}
+
+		metrics.DockerReconnects.Inc()
+		log.Println("NOTICE [source:docker] Reconnected")
+
+		if err := ds.resync(); err != nil {
+			log.Println("ERROR [source:docker]", err)
+			ds.SetError(err)
+		} else {
+			ds.SetError(nil)
+			ds.SetSynced()
+		}
+
+		return true
+	}
+}
+
+// resync adds the running containers that aren't known yet, and removes the
+// known ones that are no longer running.
+func (ds *DockerSource) resync() error {
+	cs, err := ds.d.ListContainers(docker.ListContainersOptions{})
+	if err != nil {
+		return err
+	}
+
+	evs := []*shared.ChangeEvent{}
+	running := map[shared.ContainerID]bool{}
+	for _, c := range cs {
+		cId := shared.ContainerID(c.ID)
+		running[cId] = true
+
+		if _, ok := ds.Containers[cId]; !ok {
+			cevs, err := ds.addContainer(cId)
+			if err != nil {
+				log.Println("ERROR [source:docker]", err)
+			}
+			evs = append(evs, cevs...)
+		}
+	}
+
+	for cId := range ds.Containers {
+		if !running[cId] {
+			evs = append(evs, ds.removeContainer(cId)...)
+		}
+	}
+
+	ds.send(evs)
+	return nil
 }
 
 func (ds DockerSource) handleAdd(cId shared.ContainerID) error {
+	evs, err := ds.addContainer(cId)
+	ds.send(evs)
+
+	return err
+}
+
+func (ds DockerSource) handleRemove(cId shared.ContainerID) {
+	ds.send(ds.removeContainer(cId))
+}
+
+func (ds DockerSource) handleDrain(cId shared.ContainerID) {
+	cd, ok := ds.Containers[cId]
+	if !ok {
+		return
+	}
+
+	evs := []*shared.ChangeEvent{}
+	for _, h := range cd.Hostnames {
+		evs = append(evs, shared.NewChangeEvent(shared.EventDrain, h, cd.Endpoint))
+	}
+	ds.send(evs)
+}
+
+// handleKilled adds the routes of a container that was sent a signal again if
+// it's still running, the signal didn't stop it.
+func (ds DockerSource) handleKilled(cId shared.ContainerID) error {
+	if _, ok := ds.Containers[cId]; !ok {
+		return nil
+	}
+
 	c, err := ds.d.InspectContainer(string(cId))
 	if err != nil {
 		return err
 	}
 
-	cd := parseContainer(c)
+	if !c.State.Running {
+		return nil
+	}
+
+	log.Printf("NOTICE [source:docker] Container %s is still running after a kill, adding it again", cId)
+	return ds.handleAdd(cId)
+}
+
+func (ds DockerSource) addContainer(cId shared.ContainerID) ([]*shared.ChangeEvent, error) {
+	c, err := ds.d.InspectContainer(string(cId))
+	if err != nil {
+		return nil, err
+	}
+
+	ns := networkSettings{}
+	if c.NetworkSettings != nil {
+		ns.IPAddress = c.NetworkSettings.IPAddress
+	}
+
+	// The IPv6 address is only needed when it's preferred or the only one
+	if ds.preferIPv6 || ns.IPAddress == "" {
+		v6, err := ds.api.inspectNetwork(c.ID)
+		if err != nil {
+			return nil, err
+		}
+		ns.GlobalIPv6Address = v6.GlobalIPv6Address
+	}
+
+	cd := parseContainer(c, ns, ds.preferIPv6)
 	ds.Containers[cId] = cd
 
+	evs := []*shared.ChangeEvent{}
 	for _, h := range cd.Hostnames {
-		e := shared.NewChangeEvent("add", h, cd.Endpoint)
-		ds.cce <- e
+		evs = append(evs, shared.NewChangeEvent(shared.EventAdd, h, cd.Endpoint))
 	}
 
-	return nil
+	return evs, nil
 }
 
-func (ds DockerSource) handleRemove(cId shared.ContainerID) {
+func (ds DockerSource) removeContainer(cId shared.ContainerID) []*shared.ChangeEvent {
 	cd, ok := ds.Containers[cId]
 	if !ok {
-		return
+		return nil
 	}
 
 	delete(ds.Containers, cId)
+
+	evs := []*shared.ChangeEvent{}
 	for _, h := range cd.Hostnames {
-		e := shared.NewChangeEvent("remove", h, cd.Endpoint)
-		ds.cce <- e
+		evs = append(evs, shared.NewChangeEvent(shared.EventRemove, h, cd.Endpoint))
+	}
+
+	return evs
+}
+
+// send sends the events of a container as they are, and the ones of several
+// containers as a batch.
+func (ds DockerSource) send(evs []*shared.ChangeEvent) {
+	switch len(evs) {
+	case 0:
+	case 1:
+		ds.cce <- evs[0]
+	default:
+		ds.cce <- shared.NewBatchEvent(evs)
 	}
 }
 
@@ -147,10 +359,16 @@ func (ds DockerSource) Initialise() error {
 		return err
 	}
 
+	evs := []*shared.ChangeEvent{}
 	for _, c := range cs {
-		ds.handleAdd(shared.ContainerID(c.ID))
+		cevs, err := ds.addContainer(shared.ContainerID(c.ID))
+		if err != nil {
+			log.Println("ERROR [source:docker]", err)
+		}
+		evs = append(evs, cevs...)
 	}
 
+	ds.send(evs)
 	return nil
 }
 
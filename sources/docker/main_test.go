@@ -0,0 +1,150 @@
+package docker
+
+import (
+	"context"
+	"fmt"
+	"github.com/3onyc/hipdate/shared"
+	docker "github.com/fsouza/go-dockerclient"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// newTestSource returns a source for a fake docker daemon with one container,
+// which is running while running is set.
+func newTestSource(t *testing.T, running *bool) (*DockerSource, *httptest.Server) {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/containers/abc/json" {
+			http.NotFound(w, r)
+			return
+		}
+
+		fmt.Fprintf(w, `{
+			"Id": "abc",
+			"Config": {"Env": ["WEB_HOSTNAME=example.com"]},
+			"State": {"Running": %t},
+			"NetworkSettings": {"IPAddress": "172.17.0.2"}
+		}`, *running)
+	}))
+
+	d, err := docker.NewClient(s.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	api, err := newAPIClient(s.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return &DockerSource{
+		d:          d,
+		api:        api,
+		cce:        make(chan *shared.ChangeEvent, 10),
+		kc:         make(chan shared.ContainerID),
+		Containers: ContainerMap{},
+		drainKill:  true,
+		killTime:   10 * time.Millisecond,
+	}, s
+}
+
+func expectEvent(t *testing.T, ds *DockerSource, typ shared.EventKind) {
+	select {
+	case ce := <-ds.cce:
+		if ce.Type != typ || ce.Host != "example.com" || ce.Endpoint.String() != "http://172.17.0.2:80" {
+			t.Logf("Expected a %s event, got %v", typ, ce)
+			t.Fail()
+		}
+	default:
+		t.Logf("Expected a %s event", typ)
+		t.Fail()
+	}
+}
+
+func TestKillWithoutStopping(t *testing.T) {
+	running := true
+	ds, s := newTestSource(t, &running)
+	defer s.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	if err := ds.handleEvent(ctx, &docker.APIEvents{Status: "start", ID: "abc"}); err != nil {
+		t.Fatal(err)
+	}
+	expectEvent(t, ds, shared.EventAdd)
+
+	ds.handleEvent(ctx, &docker.APIEvents{Status: "kill", ID: "abc"})
+	expectEvent(t, ds, shared.EventDrain)
+
+	select {
+	case cId := <-ds.kc:
+		if err := ds.handleKilled(cId); err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Container wasn't checked after the kill timeout")
+	}
+
+	// The container is still running, the signal didn't stop it
+	expectEvent(t, ds, shared.EventAdd)
+}
+
+func TestKillStopping(t *testing.T) {
+	running := true
+	ds, s := newTestSource(t, &running)
+	defer s.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	ds.handleEvent(ctx, &docker.APIEvents{Status: "start", ID: "abc"})
+	expectEvent(t, ds, shared.EventAdd)
+
+	ds.handleEvent(ctx, &docker.APIEvents{Status: "kill", ID: "abc"})
+	expectEvent(t, ds, shared.EventDrain)
+
+	running = false
+	if err := ds.handleKilled("abc"); err != nil || len(ds.cce) != 0 {
+		t.Logf("Expected no events for a stopped container (%v)", err)
+		t.Fail()
+	}
+
+	ds.handleEvent(ctx, &docker.APIEvents{Status: "die", ID: "abc"})
+	expectEvent(t, ds, shared.EventRemove)
+
+	if err := ds.handleKilled("abc"); err != nil || len(ds.cce) != 0 {
+		t.Logf("Expected no events for a removed container (%v)", err)
+		t.Fail()
+	}
+}
+
+func TestKillWithoutDraining(t *testing.T) {
+	running := true
+	ds, s := newTestSource(t, &running)
+	defer s.Close()
+	ds.drainKill = false
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	ds.handleEvent(ctx, &docker.APIEvents{Status: "start", ID: "abc"})
+	expectEvent(t, ds, shared.EventAdd)
+
+	ds.handleEvent(ctx, &docker.APIEvents{Status: "kill", ID: "abc"})
+	if len(ds.cce) != 0 {
+		t.Log("Expected no events for a kill without drain_on_kill")
+		t.Fail()
+	}
+
+	select {
+	case <-ds.kc:
+		t.Log("Expected no check after the kill timeout without drain_on_kill")
+		t.Fail()
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	ds.handleEvent(ctx, &docker.APIEvents{Status: "die", ID: "abc"})
+	expectEvent(t, ds, shared.EventRemove)
+}
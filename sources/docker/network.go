@@ -0,0 +1,74 @@
+package docker
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// networkSettings are the addresses of a container. The vendored docker
+// client doesn't decode GlobalIPv6Address, so it's inspected separately.
+type networkSettings struct {
+	IPAddress         string
+	GlobalIPv6Address string
+}
+
+// apiClient makes requests to the docker API that the docker client doesn't
+// cover.
+type apiClient struct {
+	c    *http.Client
+	base string
+}
+
+// newAPIClient returns a client for the docker API at endpoint, which takes
+// the same URLs as the docker client.
+func newAPIClient(endpoint string) (*apiClient, error) {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return nil, err
+	}
+
+	switch u.Scheme {
+	case "unix":
+		path := u.Path
+		dial := func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, "unix", path)
+		}
+		return &apiClient{
+			c:    &http.Client{Transport: &http.Transport{DialContext: dial}},
+			base: "http://docker",
+		}, nil
+	case "tcp":
+		u.Scheme = "http"
+		if u.Port() == "2376" {
+			u.Scheme = "https"
+		}
+	}
+
+	return &apiClient{c: http.DefaultClient, base: strings.TrimRight(u.String(), "/")}, nil
+}
+
+// inspectNetwork returns the network settings of a container.
+func (ac *apiClient) inspectNetwork(id string) (*networkSettings, error) {
+	resp, err := ac.c.Get(ac.base + "/containers/" + url.PathEscape(id) + "/json")
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("inspecting container %s returned %s", id, resp.Status)
+	}
+
+	c := struct{ NetworkSettings networkSettings }{}
+	if err := json.NewDecoder(resp.Body).Decode(&c); err != nil {
+		return nil, err
+	}
+
+	return &c.NetworkSettings, nil
+}
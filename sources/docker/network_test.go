@@ -0,0 +1,69 @@
+package docker
+
+import (
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func inspectHandler(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/containers/abc/json" {
+		http.NotFound(w, r)
+		return
+	}
+
+	w.Write([]byte(`{"Id":"abc","NetworkSettings":{"IPAddress":"172.17.0.2","GlobalIPv6Address":"fd00::2"}}`))
+}
+
+func TestInspectNetwork(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(inspectHandler))
+	defer s.Close()
+
+	ac, err := newAPIClient("tcp://" + s.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ns, err := ac.inspectNetwork("abc")
+	if err != nil || *ns != (networkSettings{"172.17.0.2", "fd00::2"}) {
+		t.Logf("Unexpected network settings %+v (%v)", ns, err)
+		t.Fail()
+	}
+
+	if _, err := ac.inspectNetwork("missing"); err == nil {
+		t.Log("Expected an error for a missing container")
+		t.Fail()
+	}
+}
+
+func TestInspectNetworkUnix(t *testing.T) {
+	dir, err := ioutil.TempDir("", "hipdate-docker")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	sock := filepath.Join(dir, "docker.sock")
+	l, err := net.Listen("unix", sock)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := &httptest.Server{Listener: l, Config: &http.Server{Handler: http.HandlerFunc(inspectHandler)}}
+	s.Start()
+	defer s.Close()
+
+	ac, err := newAPIClient("unix://" + sock)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if ns, err := ac.inspectNetwork("abc"); err != nil || ns.GlobalIPv6Address != "fd00::2" {
+		t.Logf("Unexpected network settings %+v (%v)", ns, err)
+		t.Fail()
+	}
+}
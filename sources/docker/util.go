@@ -15,18 +15,48 @@ func parseHostnameVar(hostnameVar string) []string {
 	return strings.Split(hostnameVar, "|")
 }
 
+// getHostnames returns the hosts in WEB_HOSTNAME, which can include a path
+// like example.com/api. WEB_PATH sets the path of the hosts without one.
 func getHostnames(e docker.Env) []shared.Host {
 	hosts := []shared.Host{}
 
 	if ok := e.Exists("WEB_HOSTNAME"); ok {
 		for _, host := range parseHostnameVar(e.Get("WEB_HOSTNAME")) {
-			hosts = append(hosts, shared.Host(host))
+			h := shared.ParseHost(host)
+			if h.Path() == "" && e.Get("WEB_PATH") != "" {
+				h = shared.NewHost(h.Name(), e.Get("WEB_PATH"))
+			}
+			hosts = append(hosts, h)
 		}
 	}
 
 	return hosts
 }
 
+// getMetadata sets the weight and tags of e from WEB_WEIGHT and WEB_TAGS, and
+// its health check from WEB_HEALTH_PATH, WEB_HEALTH_STATUS and so on.
+func getMetadata(env docker.Env, e *shared.Endpoint) error {
+	if env.Exists("WEB_WEIGHT") {
+		w, err := shared.ParseWeight(env.Get("WEB_WEIGHT"))
+		if err != nil {
+			return err
+		}
+		e.Weight = w
+	}
+
+	e.Tags = shared.JoinTags(strings.Split(env.Get("WEB_TAGS"), ","))
+
+	for _, k := range shared.HealthCheckSettings {
+		if v := env.Get("WEB_HEALTH_" + strings.ToUpper(k)); v != "" {
+			if err := e.Check.Set(k, v); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
 func getPort(e docker.Env) (uint32, error) {
 	if ok := e.Exists("WEB_PORT"); !ok {
 		return 80, nil
@@ -40,7 +70,17 @@ func getPort(e docker.Env) (uint32, error) {
 	return uint32(p), nil
 }
 
-func parseContainer(c *docker.Container) *ContainerData {
+// getAddress returns the IPv4 address of the container, or the global IPv6
+// address if preferred. The other one is used when it has only one.
+func getAddress(ns networkSettings, preferIPv6 bool) string {
+	if preferIPv6 && ns.GlobalIPv6Address != "" || ns.IPAddress == "" {
+		return ns.GlobalIPv6Address
+	}
+
+	return ns.IPAddress
+}
+
+func parseContainer(c *docker.Container, ns networkSettings, preferIPv6 bool) *ContainerData {
 	env := docker.Env(c.Config.Env)
 	hosts := getHostnames(env)
 	port, err := getPort(env)
@@ -53,8 +93,11 @@ func parseContainer(c *docker.Container) *ContainerData {
 		port = 80
 	}
 
-	return NewContainerData(
-		*shared.NewEndpoint("http", c.NetworkSettings.IPAddress, port),
-		hosts,
-	)
+	e := shared.NewEndpoint("http", getAddress(ns, preferIPv6), port)
+	e.Origin.Id = c.ID
+	if err := getMetadata(env, e); err != nil {
+		log.Printf("WARN Invalid metadata for container %s, ignoring: %s", c.ID, err)
+	}
+
+	return NewContainerData(*e, hosts)
 }
@@ -1,6 +1,7 @@
 package docker
 
 import (
+	"github.com/3onyc/hipdate/shared"
 	docker "github.com/fsouza/go-dockerclient"
 	"testing"
 )
@@ -45,3 +46,64 @@ func TestGetHostnamesNone(t *testing.T) {
 		t.Fail()
 	}
 }
+
+func TestGetHostnamesPath(t *testing.T) {
+	e := docker.Env{"WEB_HOSTNAME=foo/api/|bar/v1", "WEB_PATH=/api"}
+	if h := getHostnames(e); len(h) != 2 || h[0] != "foo/api" || h[1] != "bar/v1" {
+		t.Fail()
+	}
+
+	e = docker.Env{"WEB_HOSTNAME=foo", "WEB_PATH=/api"}
+	if h := getHostnames(e); len(h) != 1 || h[0] != "foo/api" {
+		t.Fail()
+	}
+}
+
+func TestGetMetadata(t *testing.T) {
+	e := shared.Endpoint{}
+	env := docker.Env{"WEB_WEIGHT=3", "WEB_TAGS=canary, eu"}
+	if err := getMetadata(env, &e); err != nil || e.Weight != 3 || e.Tags != "canary,eu" {
+		t.Logf("Unexpected metadata %+v (%v)", e, err)
+		t.Fail()
+	}
+
+	if err := getMetadata(docker.Env{"WEB_WEIGHT=0"}, &e); err != shared.InvalidWeightError {
+		t.Logf("Expected InvalidWeightError, got %v", err)
+		t.Fail()
+	}
+
+	if err := getMetadata(docker.Env{"WEB_WEIGHT=100000"}, &e); err != nil || e.Weight != shared.MaxWeight {
+		t.Logf("Expected the weight to be capped at %d, got %d (%v)", shared.MaxWeight, e.Weight, err)
+		t.Fail()
+	}
+
+	e = shared.Endpoint{}
+	env = docker.Env{"WEB_HEALTH_PATH=/ping", "WEB_HEALTH_STATUS=204"}
+	if err := getMetadata(env, &e); err != nil || e.Check != (shared.HealthCheck{Path: "/ping", Status: 204}) {
+		t.Logf("Unexpected health check %+v (%v)", e.Check, err)
+		t.Fail()
+	}
+}
+
+func TestGetAddress(t *testing.T) {
+	ns := networkSettings{IPAddress: "172.17.0.2", GlobalIPv6Address: "fd00::2"}
+	if a := getAddress(ns, false); a != "172.17.0.2" {
+		t.Logf("Expected 172.17.0.2, got %s", a)
+		t.Fail()
+	}
+
+	if a := getAddress(ns, true); a != "fd00::2" {
+		t.Logf("Expected fd00::2, got %s", a)
+		t.Fail()
+	}
+
+	if a := getAddress(networkSettings{IPAddress: "172.17.0.2"}, true); a != "172.17.0.2" {
+		t.Logf("Expected fallback to 172.17.0.2, got %s", a)
+		t.Fail()
+	}
+
+	if a := getAddress(networkSettings{GlobalIPv6Address: "fd00::2"}, false); a != "fd00::2" {
+		t.Logf("Expected fallback to fd00::2, got %s", a)
+		t.Fail()
+	}
+}
@@ -1,15 +1,16 @@
 package file
 
 import (
+	"context"
 	"encoding/csv"
 	"errors"
+	"fmt"
 	"github.com/3onyc/hipdate/shared"
 	"github.com/3onyc/hipdate/sources"
 	"gopkg.in/fsnotify.v1"
 	"log"
 	"os"
 	"path"
-	"sync"
 )
 
 var (
@@ -17,19 +18,15 @@ var (
 )
 
 type FileSource struct {
+	*sources.StatusTracker
 	cce chan *shared.ChangeEvent
-	wg  *sync.WaitGroup
-	sc  chan bool
 	p   string
 	lf  [][]string
-	w   *fsnotify.Watcher
 }
 
 func NewFileSource(
 	opt shared.OptionMap,
 	cce chan *shared.ChangeEvent,
-	wg *sync.WaitGroup,
-	sc chan bool,
 ) (
 	sources.Source,
 	error,
@@ -40,14 +37,14 @@ func NewFileSource(
 	}
 
 	return &FileSource{
-		cce: cce,
-		wg:  wg,
-		sc:  sc,
-		p:   p,
+		StatusTracker: sources.NewStatusTracker(),
+		cce:           cce,
+		p:             p,
 	}, nil
 }
 
 func (fs *FileSource) eventHandler(
+	ctx context.Context,
 	cfe chan fsnotify.Event,
 	ce chan error,
 ) {
@@ -65,46 +62,43 @@ func (fs *FileSource) eventHandler(
 				if err != nil {
 					log.Println("CRITICAL [source:file]", err)
 				}
+				fs.SetError(err)
 
-				fs.processRecords("remove", fs.lf)
-				fs.processRecords("add", r)
+				fs.send(fs.diff(fs.lf, r))
 				fs.lf = r
 			}
-		case <-fs.sc:
-			fs.Stop()
+		case <-ctx.Done():
 			return
 		}
 	}
 }
 
-func (fs *FileSource) Stop() {
-	log.Println("INFO [source:file] Stopping watcher ...")
-	if err := fs.w.Remove(path.Dir(fs.p)); err != nil {
-		log.Println("ERROR [source:file] watcher:", err)
-	}
-
-	fs.wg.Done()
-}
-
-func (fs *FileSource) Start() {
-	fs.wg.Add(1)
-
+func (fs *FileSource) Start(ctx context.Context) error {
 	log.Println("INFO [source:file] Loading file source...")
 	if err := fs.Initialise(); err != nil {
 		log.Println("ERROR [source:file]", err)
+		fs.SetError(err)
+	} else {
+		fs.SetSynced()
 	}
 
 	log.Println("INFO [source:file] Starting watcher ...")
 	w, err := fsnotify.NewWatcher()
 	if err != nil {
-		log.Println("ERROR [source:file]", err)
-		return
+		fs.SetError(err)
+		return err
 	}
+	defer w.Close()
 
-	fs.w = w
-	fs.w.Add(path.Dir(fs.p))
+	if err := w.Add(path.Dir(fs.p)); err != nil {
+		fs.SetError(err)
+		return err
+	}
+
+	fs.eventHandler(ctx, w.Events, w.Errors)
 
-	fs.eventHandler(fs.w.Events, fs.w.Errors)
+	log.Println("INFO [source:file] Stopped watcher")
+	return nil
 }
 
 func (fs *FileSource) Initialise() error {
@@ -113,7 +107,7 @@ func (fs *FileSource) Initialise() error {
 		return err
 	}
 	fs.lf = r
-	fs.processRecords("add", r)
+	fs.send(fs.processRecords(shared.EventAdd, r))
 
 	return nil
 }
@@ -134,9 +128,57 @@ func (fs *FileSource) processFile() ([][]string, error) {
 	return rec, nil
 }
 
-func (fs *FileSource) processRecords(e string, r [][]string) {
-	for _, l := range r {
-		h := shared.Host(l[0])
+// send sends the events of a (re)load as one batch.
+func (fs *FileSource) send(evs []*shared.ChangeEvent) {
+	if len(evs) > 0 {
+		fs.cce <- shared.NewBatchEvent(evs)
+	}
+}
+
+// diff returns the events turning the routes of the records old into the
+// ones of new. Unchanged routes get no events, so they stay in the backend,
+// the ones that only moved to another line are added again to update their
+// origin.
+func (fs *FileSource) diff(old, new [][]string) []*shared.ChangeEvent {
+	type route struct {
+		h shared.Host
+		e shared.Endpoint
+	}
+	key := func(ce *shared.ChangeEvent) route {
+		e := ce.Endpoint
+		e.Origin = shared.Origin{}
+		return route{ce.Host, e}
+	}
+
+	removes, adds := fs.processRecords(shared.EventRemove, old), fs.processRecords(shared.EventAdd, new)
+	olds, news := map[route]shared.Origin{}, map[route]bool{}
+	for _, ce := range removes {
+		olds[key(ce)] = ce.Endpoint.Origin
+	}
+	for _, ce := range adds {
+		news[key(ce)] = true
+	}
+
+	evs := []*shared.ChangeEvent{}
+	for _, ce := range removes {
+		if !news[key(ce)] {
+			evs = append(evs, ce)
+		}
+	}
+
+	for _, ce := range adds {
+		if o, ok := olds[key(ce)]; !ok || o != ce.Endpoint.Origin {
+			evs = append(evs, ce)
+		}
+	}
+
+	return evs
+}
+
+func (fs *FileSource) processRecords(k shared.EventKind, r [][]string) []*shared.ChangeEvent {
+	evs := []*shared.ChangeEvent{}
+	for i, l := range r {
+		h := shared.ParseHost(l[0])
 		for _, u := range l[1:] {
 			ep, err := shared.NewEndpointFromUrl(u)
 			if err != nil {
@@ -144,10 +186,12 @@ func (fs *FileSource) processRecords(e string, r [][]string) {
 				continue
 			}
 
-			ce := shared.NewChangeEvent(e, h, *ep)
-			fs.cce <- ce
+			ep.Origin.Id = fmt.Sprintf("%s:%d", fs.p, i+1)
+			evs = append(evs, shared.NewChangeEvent(k, h, *ep))
 		}
 	}
+
+	return evs
 }
 
 func init() {
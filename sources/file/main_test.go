@@ -0,0 +1,57 @@
+package file
+
+import (
+	"github.com/3onyc/hipdate/shared"
+	"testing"
+)
+
+func TestDiffOnlySendsChanges(t *testing.T) {
+	fs := &FileSource{p: "hosts.csv"}
+	old := [][]string{
+		{"a.com", "http://10.0.0.1:80", "http://10.0.0.2:80"},
+		{"b.com", "http://10.0.0.3:80"},
+	}
+	new := [][]string{
+		{"b.com", "http://10.0.0.3:80"},
+		{"a.com", "http://10.0.0.1:80", "http://10.0.0.4:80"},
+	}
+
+	expected := []string{
+		"remove a.com http://10.0.0.2:80 hosts.csv:1",
+		"add b.com http://10.0.0.3:80 hosts.csv:1",
+		"add a.com http://10.0.0.1:80 hosts.csv:2",
+		"add a.com http://10.0.0.4:80 hosts.csv:2",
+	}
+
+	evs := fs.diff(old, new)
+	for i, ce := range evs {
+		s := ce.Type.String() + " " + string(ce.Host) + " " + ce.Endpoint.String() + " " + ce.Endpoint.Origin.Id
+		if i >= len(expected) || s != expected[i] {
+			t.Logf("Unexpected event %d: %s", i, s)
+			t.Fail()
+		}
+	}
+
+	if len(evs) != len(expected) {
+		t.Logf("Expected %d events, got %d", len(expected), len(evs))
+		t.Fail()
+	}
+
+	if evs := fs.diff(new, new); len(evs) != 0 {
+		t.Logf("Expected no events for an unchanged file, got %v", evs)
+		t.Fail()
+	}
+}
+
+func TestDiffMetadata(t *testing.T) {
+	fs := &FileSource{p: "hosts.csv"}
+	evs := fs.diff(
+		[][]string{{"a.com", "http://10.0.0.1:80"}},
+		[][]string{{"a.com", "http://10.0.0.1:80?weight=2"}},
+	)
+
+	if len(evs) != 2 || evs[0].Type != shared.EventRemove || evs[1].Endpoint.Weight != 2 {
+		t.Logf("Unexpected events for a weight change %v", evs)
+		t.Fail()
+	}
+}
@@ -0,0 +1,275 @@
+package kubernetes
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+type ObjectMeta struct {
+	Name            string `json:"name"`
+	Namespace       string `json:"namespace"`
+	ResourceVersion string `json:"resourceVersion"`
+}
+
+type ListMeta struct {
+	ResourceVersion string `json:"resourceVersion"`
+}
+
+type EndpointAddress struct {
+	IP string `json:"ip"`
+}
+
+type EndpointPort struct {
+	Name     string `json:"name"`
+	Port     uint32 `json:"port"`
+	Protocol string `json:"protocol"`
+}
+
+type EndpointSubset struct {
+	Addresses         []EndpointAddress `json:"addresses"`
+	NotReadyAddresses []EndpointAddress `json:"notReadyAddresses"`
+	Ports             []EndpointPort    `json:"ports"`
+}
+
+type Endpoints struct {
+	Metadata ObjectMeta       `json:"metadata"`
+	Subsets  []EndpointSubset `json:"subsets"`
+}
+
+type EndpointsList struct {
+	Metadata ListMeta    `json:"metadata"`
+	Items    []Endpoints `json:"items"`
+}
+
+// IntOrString mirrors the kubernetes type of the same name, ingress backends
+// refer to a service port either by number or by name.
+type IntOrString struct {
+	IntVal uint32
+	StrVal string
+}
+
+func (is *IntOrString) UnmarshalJSON(b []byte) error {
+	if len(b) > 0 && b[0] == '"' {
+		return json.Unmarshal(b, &is.StrVal)
+	}
+
+	return json.Unmarshal(b, &is.IntVal)
+}
+
+func (is IntOrString) MarshalJSON() ([]byte, error) {
+	if is.StrVal != "" {
+		return json.Marshal(is.StrVal)
+	}
+
+	return json.Marshal(is.IntVal)
+}
+
+// IngressBackend is the service an ingress routes to, given by ServiceName and
+// ServicePort in extensions/v1beta1, and by Service in networking.k8s.io/v1.
+type IngressBackend struct {
+	ServiceName string                 `json:"serviceName"`
+	ServicePort IntOrString            `json:"servicePort"`
+	Service     *IngressServiceBackend `json:"service"`
+}
+
+type IngressServiceBackend struct {
+	Name string             `json:"name"`
+	Port ServiceBackendPort `json:"port"`
+}
+
+type ServiceBackendPort struct {
+	Name   string `json:"name"`
+	Number uint32 `json:"number"`
+}
+
+// service returns the name and port of the service, whichever API version
+// the backend came from.
+func (b IngressBackend) service() (string, IntOrString) {
+	if b.Service != nil {
+		return b.Service.Name, IntOrString{IntVal: b.Service.Port.Number, StrVal: b.Service.Port.Name}
+	}
+
+	return b.ServiceName, b.ServicePort
+}
+
+type HTTPIngressPath struct {
+	Path    string         `json:"path"`
+	Backend IngressBackend `json:"backend"`
+}
+
+type HTTPIngressRuleValue struct {
+	Paths []HTTPIngressPath `json:"paths"`
+}
+
+type IngressRule struct {
+	Host string                `json:"host"`
+	HTTP *HTTPIngressRuleValue `json:"http"`
+}
+
+// IngressSpec has the backend for rules without paths in Backend in
+// extensions/v1beta1, and in DefaultBackend in networking.k8s.io/v1.
+type IngressSpec struct {
+	Backend        *IngressBackend `json:"backend"`
+	DefaultBackend *IngressBackend `json:"defaultBackend"`
+	Rules          []IngressRule   `json:"rules"`
+}
+
+func (is IngressSpec) defaultBackend() *IngressBackend {
+	if is.DefaultBackend != nil {
+		return is.DefaultBackend
+	}
+
+	return is.Backend
+}
+
+type Ingress struct {
+	Metadata ObjectMeta  `json:"metadata"`
+	Spec     IngressSpec `json:"spec"`
+}
+
+type IngressList struct {
+	Metadata ListMeta  `json:"metadata"`
+	Items    []Ingress `json:"items"`
+}
+
+type WatchEvent struct {
+	Type   string          `json:"type"`
+	Object json.RawMessage `json:"object"`
+}
+
+type resource struct {
+	prefix string
+	name   string
+}
+
+const (
+	// DefaultIngressApi is the API group and version ingresses are read from,
+	// extensions/v1beta1 was removed in kubernetes 1.22.
+	DefaultIngressApi = "networking.k8s.io/v1"
+)
+
+var endpointsResource = resource{"/api/v1", "endpoints"}
+
+// ingressResource returns the ingresses of the API group and version api.
+func ingressResource(api string) resource {
+	return resource{"/apis/" + strings.Trim(api, "/"), "ingresses"}
+}
+
+type client struct {
+	url   string
+	ns    string
+	token string
+	hc    *http.Client
+}
+
+func newClient(u, ns, token string, tc *tls.Config) *client {
+	tr := &http.Transport{
+		Proxy:           http.ProxyFromEnvironment,
+		TLSClientConfig: tc,
+	}
+
+	return &client{
+		url:   strings.TrimRight(u, "/"),
+		ns:    ns,
+		token: token,
+		hc:    &http.Client{Transport: tr},
+	}
+}
+
+func (c *client) path(r resource) string {
+	if c.ns == "" {
+		return c.url + r.prefix + "/" + r.name
+	}
+
+	return c.url + r.prefix + "/namespaces/" + c.ns + "/" + r.name
+}
+
+func (c *client) get(ctx context.Context, r resource, q url.Values) (io.ReadCloser, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", c.path(r)+"?"+q.Encode(), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	if c.token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	}
+
+	resp, err := c.hc.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		b, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		return nil, fmt.Errorf("%s: %s %s", r.name, resp.Status, strings.TrimSpace(string(b)))
+	}
+
+	return resp.Body, nil
+}
+
+func (c *client) list(ctx context.Context, r resource) (*objectEvent, string, error) {
+	b, err := c.get(ctx, r, url.Values{})
+	if err != nil {
+		return nil, "", err
+	}
+	defer b.Close()
+
+	oe := &objectEvent{Resource: r, Type: "SYNC"}
+	switch r {
+	case endpointsResource:
+		var l EndpointsList
+		if err := json.NewDecoder(b).Decode(&l); err != nil {
+			return nil, "", err
+		}
+		oe.Endpoints = l.Items
+		return oe, l.Metadata.ResourceVersion, nil
+	default:
+		var l IngressList
+		if err := json.NewDecoder(b).Decode(&l); err != nil {
+			return nil, "", err
+		}
+		oe.Ingresses = l.Items
+		return oe, l.Metadata.ResourceVersion, nil
+	}
+}
+
+func (c *client) watch(ctx context.Context, r resource, rv string) (io.ReadCloser, error) {
+	return c.get(ctx, r, url.Values{
+		"watch":           []string{"true"},
+		"resourceVersion": []string{rv},
+	})
+}
+
+// decodeWatchEvent turns a single watch event into an objectEvent, returning
+// the resource version of the object it carried.
+func decodeWatchEvent(r resource, we *WatchEvent) (*objectEvent, string, error) {
+	oe := &objectEvent{Resource: r, Type: we.Type}
+	switch r {
+	case endpointsResource:
+		var e Endpoints
+		if err := json.Unmarshal(we.Object, &e); err != nil {
+			return nil, "", err
+		}
+		oe.Endpoints = []Endpoints{e}
+		return oe, e.Metadata.ResourceVersion, nil
+	default:
+		var i Ingress
+		if err := json.Unmarshal(we.Object, &i); err != nil {
+			return nil, "", err
+		}
+		oe.Ingresses = []Ingress{i}
+		return oe, i.Metadata.ResourceVersion, nil
+	}
+}
+
+func objectKey(m ObjectMeta) string {
+	return m.Namespace + "/" + m.Name
+}
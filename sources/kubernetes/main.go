@@ -0,0 +1,414 @@
+package kubernetes
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"github.com/3onyc/hipdate/shared"
+	"github.com/3onyc/hipdate/sources"
+	"io"
+	"io/ioutil"
+	"log"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	MissingApiUrlError = errors.New("kubernetes api url not specified")
+	InvalidCaFileError = errors.New("no certificates found in ca_file")
+)
+
+const (
+	watchRetryDelay = 5 * time.Second
+)
+
+type routeSet map[shared.Host]map[shared.Endpoint]bool
+
+// hasAddress reports whether the set has e for h, from any service.
+func (rs routeSet) hasAddress(h shared.Host, e shared.Endpoint) bool {
+	for ep := range rs[h] {
+		if ep.Bare() == e.Bare() {
+			return true
+		}
+	}
+
+	return false
+}
+
+// objectEvent is passed from the watchers to the main loop, Type is either
+// one of the kubernetes watch event types, or SYNC for a full listing.
+type objectEvent struct {
+	Resource  resource
+	Type      string
+	Ingresses []Ingress
+	Endpoints []Endpoints
+}
+
+type KubernetesSource struct {
+	*sources.StatusTracker
+	c         *client
+	cce       chan *shared.ChangeEvent
+	coe       chan *objectEvent
+	ingresses map[string]Ingress
+	endpoints map[string]Endpoints
+	routes    routeSet
+	synced    map[resource]bool
+	ingress   resource
+}
+
+func NewKubernetesSource(
+	opt shared.OptionMap,
+	cce chan *shared.ChangeEvent,
+) (
+	sources.Source,
+	error,
+) {
+	u, ok := opt["url"]
+	if !ok {
+		return nil, MissingApiUrlError
+	}
+
+	token := opt["token"]
+	if tf, ok := opt["token_file"]; ok {
+		b, err := ioutil.ReadFile(tf)
+		if err != nil {
+			return nil, err
+		}
+		token = strings.TrimSpace(string(b))
+	}
+
+	tc, err := tlsConfig(opt)
+	if err != nil {
+		return nil, err
+	}
+
+	api := opt["ingress_api"]
+	if api == "" {
+		api = DefaultIngressApi
+	}
+
+	return &KubernetesSource{
+		StatusTracker: sources.NewStatusTracker(),
+		c:             newClient(u, opt["namespace"], token, tc),
+		cce:           cce,
+		coe:           make(chan *objectEvent),
+		ingresses:     map[string]Ingress{},
+		endpoints:     map[string]Endpoints{},
+		routes:        routeSet{},
+		synced:        map[resource]bool{},
+		ingress:       ingressResource(api),
+	}, nil
+}
+
+// tlsConfig returns the TLS settings for the API server, which is verified
+// against the certificates in ca_file if it's set, e.g. the service account
+// CA in a cluster, or not at all if insecure is set.
+func tlsConfig(opt shared.OptionMap) (*tls.Config, error) {
+	tc := &tls.Config{InsecureSkipVerify: opt["insecure"] == "true"}
+
+	if cf, ok := opt["ca_file"]; ok {
+		b, err := ioutil.ReadFile(cf)
+		if err != nil {
+			return nil, err
+		}
+
+		tc.RootCAs = x509.NewCertPool()
+		if !tc.RootCAs.AppendCertsFromPEM(b) {
+			return nil, InvalidCaFileError
+		}
+	}
+
+	return tc, nil
+}
+
+// Start watches the endpoints and ingresses until ctx is done, which also
+// aborts the watch requests, and waits for the watchers to return.
+func (ks *KubernetesSource) Start(ctx context.Context) error {
+	log.Println("NOTICE [source:kubernetes] Starting...")
+
+	wg := &sync.WaitGroup{}
+	for _, r := range []resource{endpointsResource, ks.ingress} {
+		wg.Add(1)
+		go func(r resource) {
+			defer wg.Done()
+			ks.watch(ctx, r)
+		}(r)
+	}
+
+	ks.eventHandler(ctx)
+	wg.Wait()
+
+	log.Println("NOTICE [source:kubernetes] Stopped")
+	return nil
+}
+
+func (ks *KubernetesSource) eventHandler(ctx context.Context) {
+	for {
+		select {
+		case oe := <-ks.coe:
+			ks.handleEvent(oe)
+			ks.reconcile()
+
+			if oe.Type == "SYNC" {
+				ks.synced[oe.Resource] = true
+				if len(ks.synced) == 2 {
+					ks.SetSynced()
+				}
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (ks *KubernetesSource) handleEvent(oe *objectEvent) {
+	log.Printf("DEBUG [source:kubernetes] received (%s) %s", oe.Type, oe.Resource.name)
+
+	if oe.Type == "SYNC" {
+		switch oe.Resource {
+		case endpointsResource:
+			ks.endpoints = map[string]Endpoints{}
+		case ks.ingress:
+			ks.ingresses = map[string]Ingress{}
+		}
+	}
+
+	for _, e := range oe.Endpoints {
+		if oe.Type == "DELETED" {
+			delete(ks.endpoints, objectKey(e.Metadata))
+		} else {
+			ks.endpoints[objectKey(e.Metadata)] = e
+		}
+	}
+
+	for _, i := range oe.Ingresses {
+		if oe.Type == "DELETED" {
+			delete(ks.ingresses, objectKey(i.Metadata))
+		} else {
+			ks.ingresses[objectKey(i.Metadata)] = i
+		}
+	}
+}
+
+// reconcile compares the routes derived from the current ingresses and
+// endpoints with the ones sent previously, and emits the difference.
+func (ks *KubernetesSource) reconcile() {
+	d := ks.desiredRoutes()
+
+	evs := []*shared.ChangeEvent{}
+	for h, eps := range ks.routes {
+		for ep := range eps {
+			if !d[h][ep] {
+				evs = append(evs, shared.NewChangeEvent(shared.EventRemove, h, ep))
+			}
+		}
+	}
+
+	for h, eps := range d {
+		for ep := range eps {
+			if !ks.routes[h][ep] {
+				evs = append(evs, shared.NewChangeEvent(shared.EventAdd, h, ep))
+			}
+		}
+	}
+
+	if len(evs) > 0 {
+		ks.cce <- shared.NewBatchEvent(evs)
+	}
+
+	ks.routes = d
+}
+
+func (ks *KubernetesSource) desiredRoutes() routeSet {
+	rs := routeSet{}
+
+	for _, i := range ks.ingresses {
+		ns := i.Metadata.Namespace
+		for _, r := range i.Spec.Rules {
+			if r.Host == "" {
+				continue
+			}
+
+			bs := map[shared.Host][]IngressBackend{}
+			if r.HTTP != nil {
+				for _, p := range r.HTTP.Paths {
+					h := shared.NewHost(r.Host, p.Path)
+					bs[h] = append(bs[h], p.Backend)
+				}
+			} else if b := i.Spec.defaultBackend(); b != nil {
+				h := shared.NewHost(r.Host, "")
+				bs[h] = append(bs[h], *b)
+			}
+
+			for h, hbs := range bs {
+				for _, b := range hbs {
+					for _, ep := range ks.backendEndpoints(ns, b) {
+						if rs[h] == nil {
+							rs[h] = map[shared.Endpoint]bool{}
+						}
+						if !rs.hasAddress(h, ep) {
+							rs[h][ep] = true
+						}
+					}
+				}
+			}
+		}
+	}
+
+	return rs
+}
+
+// backendEndpoints returns the ready addresses of the service an ingress
+// backend points to. Named service ports are matched against the endpoint
+// port names, numbered ones against the port number, falling back to the only
+// port of a subset, since the endpoints only know about target ports.
+func (ks *KubernetesSource) backendEndpoints(
+	ns string,
+	b IngressBackend,
+) []shared.Endpoint {
+	eps := []shared.Endpoint{}
+	name, port := b.service()
+
+	e, ok := ks.endpoints[ns+"/"+name]
+	if !ok {
+		return eps
+	}
+
+	for _, s := range e.Subsets {
+		p, ok := subsetPort(s, port)
+		if !ok {
+			continue
+		}
+
+		for _, a := range s.Addresses {
+			ep := shared.NewEndpoint("http", a.IP, p)
+			ep.Origin.Id = ns + "/" + name
+			eps = append(eps, *ep)
+		}
+	}
+
+	return eps
+}
+
+func subsetPort(s EndpointSubset, sp IntOrString) (uint32, bool) {
+	for _, p := range s.Ports {
+		if sp.StrVal != "" && p.Name == sp.StrVal {
+			return p.Port, true
+		}
+		if sp.StrVal == "" && p.Port == sp.IntVal {
+			return p.Port, true
+		}
+	}
+
+	if sp.StrVal == "" && len(s.Ports) == 1 {
+		return s.Ports[0].Port, true
+	}
+
+	return 0, false
+}
+
+// watch lists the resource and keeps watching it from the listed resource
+// version, starting over with a fresh listing whenever the watch fails.
+func (ks *KubernetesSource) watch(ctx context.Context, r resource) {
+	rv := ""
+	for ctx.Err() == nil {
+		if rv == "" {
+			oe, lrv, err := ks.c.list(ctx, r)
+			if ctx.Err() != nil {
+				return
+			}
+			ks.SetError(err)
+			if err != nil {
+				log.Println("ERROR [source:kubernetes]", err)
+				if !ks.sleep(ctx, watchRetryDelay) {
+					return
+				}
+				continue
+			}
+
+			if !ks.send(ctx, oe) {
+				return
+			}
+			rv = lrv
+		}
+
+		b, err := ks.c.watch(ctx, r, rv)
+		if ctx.Err() != nil {
+			return
+		}
+		ks.SetError(err)
+		if err != nil {
+			log.Println("ERROR [source:kubernetes]", err)
+			rv = ""
+			if !ks.sleep(ctx, watchRetryDelay) {
+				return
+			}
+			continue
+		}
+
+		rv = ks.readWatch(ctx, r, b, rv)
+	}
+}
+
+// readWatch forwards events from a watch stream until it ends, and returns
+// the resource version to resume from, or "" if a new listing is needed.
+func (ks *KubernetesSource) readWatch(
+	ctx context.Context,
+	r resource,
+	b io.ReadCloser,
+	rv string,
+) string {
+	defer b.Close()
+
+	d := json.NewDecoder(b)
+	for {
+		var we WatchEvent
+		if err := d.Decode(&we); err != nil {
+			if err != io.EOF && ctx.Err() == nil {
+				log.Println("WARN [source:kubernetes] watch:", err)
+			}
+			return rv
+		}
+
+		if we.Type == "ERROR" {
+			log.Printf("WARN [source:kubernetes] watch %s: %s", r.name, we.Object)
+			return ""
+		}
+
+		oe, orv, err := decodeWatchEvent(r, &we)
+		if err != nil {
+			log.Println("ERROR [source:kubernetes]", err)
+			continue
+		}
+
+		if !ks.send(ctx, oe) {
+			return rv
+		}
+		rv = orv
+	}
+}
+
+func (ks *KubernetesSource) send(ctx context.Context, oe *objectEvent) bool {
+	select {
+	case ks.coe <- oe:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+func (ks *KubernetesSource) sleep(ctx context.Context, d time.Duration) bool {
+	select {
+	case <-time.After(d):
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+func init() {
+	sources.SourceMap["kubernetes"] = NewKubernetesSource
+}
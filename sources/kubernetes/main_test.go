@@ -0,0 +1,380 @@
+package kubernetes
+
+import (
+	"context"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"github.com/3onyc/hipdate/shared"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+)
+
+const (
+	testEndpointsList = `{
+		"metadata": {"resourceVersion": "10"},
+		"items": [{
+			"metadata": {"name": "web", "namespace": "default", "resourceVersion": "9"},
+			"subsets": [{
+				"addresses": [{"ip": "10.0.0.1"}],
+				"notReadyAddresses": [{"ip": "10.0.0.2"}],
+				"ports": [{"name": "http", "port": 8080, "protocol": "TCP"}]
+			}]
+		}]
+	}`
+	testIngressList = `{
+		"metadata": {"resourceVersion": "10"},
+		"items": [{
+			"metadata": {"name": "web", "namespace": "default", "resourceVersion": "8"},
+			"spec": {"rules": [
+				{"host": "example.com", "http": {"paths": [
+					{"path": "/", "backend": {"service": {"name": "web", "port": {"name": "http"}}}}
+				]}},
+				{"host": "other.example.com", "http": {"paths": [
+					{"path": "/", "backend": {"service": {"name": "web", "port": {"number": 80}}}}
+				]}},
+				{"host": "missing.example.com", "http": {"paths": [
+					{"path": "/", "backend": {"service": {"name": "missing", "port": {"number": 80}}}}
+				]}}
+			]}
+		}]
+	}`
+	testLegacyIngressList = `{
+		"metadata": {"resourceVersion": "10"},
+		"items": [{
+			"metadata": {"name": "web", "namespace": "default", "resourceVersion": "8"},
+			"spec": {"rules": [
+				{"host": "example.com", "http": {"paths": [
+					{"path": "/", "backend": {"serviceName": "web", "servicePort": "http"}}
+				]}},
+				{"host": "other.example.com", "http": {"paths": [
+					{"path": "/", "backend": {"serviceName": "web", "servicePort": 80}}
+				]}},
+				{"host": "missing.example.com", "http": {"paths": [
+					{"path": "/", "backend": {"serviceName": "missing", "servicePort": 80}}
+				]}}
+			]}
+		}]
+	}`
+)
+
+// fakeApiServer serves fixed listings, and streams whatever is pushed onto
+// the watch channel of a resource to its watchers.
+type fakeApiServer struct {
+	*httptest.Server
+	done    chan struct{}
+	watches map[string]chan *WatchEvent
+}
+
+// newFakeApiServer serves networking.k8s.io/v1 and extensions/v1beta1
+// ingresses, over TLS if secure is set.
+func newFakeApiServer(secure bool) *fakeApiServer {
+	fs := &fakeApiServer{
+		done: make(chan struct{}),
+		watches: map[string]chan *WatchEvent{
+			"endpoints": make(chan *WatchEvent),
+			"ingresses": make(chan *WatchEvent),
+		},
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/v1/endpoints", fs.handler("endpoints", testEndpointsList))
+	mux.HandleFunc("/apis/networking.k8s.io/v1/ingresses", fs.handler("ingresses", testIngressList))
+	mux.HandleFunc("/apis/extensions/v1beta1/ingresses", fs.handler("ingresses", testLegacyIngressList))
+
+	if secure {
+		fs.Server = httptest.NewTLSServer(mux)
+	} else {
+		fs.Server = httptest.NewServer(mux)
+	}
+
+	return fs
+}
+
+func (fs *fakeApiServer) handler(name, list string) http.HandlerFunc {
+	return func(rw http.ResponseWriter, req *http.Request) {
+		if req.URL.Query().Get("watch") != "true" {
+			fmt.Fprint(rw, list)
+			return
+		}
+
+		rw.WriteHeader(200)
+		rw.(http.Flusher).Flush()
+
+		enc := json.NewEncoder(rw)
+		for {
+			select {
+			case we := <-fs.watches[name]:
+				enc.Encode(we)
+				rw.(http.Flusher).Flush()
+			case <-fs.done:
+				return
+			}
+		}
+	}
+}
+
+func (fs *fakeApiServer) Close() {
+	close(fs.done)
+	fs.Server.Close()
+}
+
+func watchEvent(t, obj string) *WatchEvent {
+	return &WatchEvent{Type: t, Object: json.RawMessage(obj)}
+}
+
+func startTestSource(t *testing.T, opt shared.OptionMap) (*KubernetesSource, chan *shared.ChangeEvent, context.CancelFunc) {
+	cce := make(chan *shared.ChangeEvent)
+
+	src, err := NewKubernetesSource(opt, cce)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go src.Start(ctx)
+	return src.(*KubernetesSource), cce, cancel
+}
+
+func expectEvents(t *testing.T, cce chan *shared.ChangeEvent, expected ...string) {
+	want := map[string]bool{}
+	for _, e := range expected {
+		want[e] = true
+	}
+
+	for len(want) > 0 {
+		select {
+		case ce := <-cce:
+			if ce.Type != shared.EventBatch {
+				t.Fatalf("Expected a batch, got '%s'", ce.Type)
+			}
+
+			for _, sce := range ce.Events {
+				k := fmt.Sprintf("%s %s %s", sce.Type, sce.Host, sce.Endpoint.String())
+				if !want[k] {
+					t.Fatalf("Unexpected event '%s'", k)
+				}
+				delete(want, k)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatalf("Timed out waiting for events %v", want)
+		}
+	}
+}
+
+func TestKubernetesSourceInitialSync(t *testing.T) {
+	fs := newFakeApiServer(false)
+	defer fs.Close()
+
+	ks, cce, cancel := startTestSource(t, shared.OptionMap{"url": fs.URL})
+	defer cancel()
+
+	expectEvents(t, cce,
+		"add example.com http://10.0.0.1:8080",
+		"add other.example.com http://10.0.0.1:8080",
+	)
+
+	for i := 0; !ks.Status().Synced; i++ {
+		if i > 100 {
+			t.Fatal("Source not synced after initial listing")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestKubernetesSourceWatch(t *testing.T) {
+	fs := newFakeApiServer(false)
+	defer fs.Close()
+
+	_, cce, cancel := startTestSource(t, shared.OptionMap{"url": fs.URL})
+	defer cancel()
+
+	expectEvents(t, cce,
+		"add example.com http://10.0.0.1:8080",
+		"add other.example.com http://10.0.0.1:8080",
+	)
+
+	fs.watches["endpoints"] <- watchEvent("MODIFIED", `{
+		"metadata": {"name": "web", "namespace": "default", "resourceVersion": "11"},
+		"subsets": [{
+			"addresses": [{"ip": "10.0.0.2"}],
+			"ports": [{"name": "http", "port": 8080, "protocol": "TCP"}]
+		}]
+	}`)
+
+	expectEvents(t, cce,
+		"remove example.com http://10.0.0.1:8080",
+		"remove other.example.com http://10.0.0.1:8080",
+		"add example.com http://10.0.0.2:8080",
+		"add other.example.com http://10.0.0.2:8080",
+	)
+
+	fs.watches["ingresses"] <- watchEvent("DELETED", `{
+		"metadata": {"name": "web", "namespace": "default", "resourceVersion": "12"}
+	}`)
+
+	expectEvents(t, cce,
+		"remove example.com http://10.0.0.2:8080",
+		"remove other.example.com http://10.0.0.2:8080",
+	)
+}
+
+func TestKubernetesSourceStop(t *testing.T) {
+	fs := newFakeApiServer(false)
+	defer fs.Close()
+
+	cce := make(chan *shared.ChangeEvent, 10)
+	src, err := NewKubernetesSource(shared.OptionMap{"url": fs.URL}, cce)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		done <- src.Start(ctx)
+	}()
+
+	expectEvents(t, cce,
+		"add example.com http://10.0.0.1:8080",
+		"add other.example.com http://10.0.0.1:8080",
+	)
+	cancel()
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Logf("Unexpected error %s", err)
+			t.Fail()
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Source didn't stop with its watches open")
+	}
+}
+
+func TestKubernetesSourceLegacyIngress(t *testing.T) {
+	fs := newFakeApiServer(false)
+	defer fs.Close()
+
+	_, cce, cancel := startTestSource(t, shared.OptionMap{"url": fs.URL, "ingress_api": "extensions/v1beta1"})
+	defer cancel()
+
+	expectEvents(t, cce,
+		"add example.com http://10.0.0.1:8080",
+		"add other.example.com http://10.0.0.1:8080",
+	)
+}
+
+func TestKubernetesSourceCaFile(t *testing.T) {
+	fs := newFakeApiServer(true)
+	defer fs.Close()
+
+	f, err := ioutil.TempFile("", "hipdate-ca")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+
+	pem.Encode(f, &pem.Block{Type: "CERTIFICATE", Bytes: fs.Certificate().Raw})
+	f.Close()
+
+	_, cce, cancel := startTestSource(t, shared.OptionMap{"url": fs.URL, "ca_file": f.Name()})
+	defer cancel()
+
+	expectEvents(t, cce,
+		"add example.com http://10.0.0.1:8080",
+		"add other.example.com http://10.0.0.1:8080",
+	)
+
+	ioutil.WriteFile(f.Name(), []byte("not a certificate"), 0600)
+	if _, err := NewKubernetesSource(shared.OptionMap{"url": fs.URL, "ca_file": f.Name()}, nil); err != InvalidCaFileError {
+		t.Logf("Expected an invalid CA file error, got %v", err)
+		t.Fail()
+	}
+}
+
+func TestSubsetPort(t *testing.T) {
+	s := EndpointSubset{Ports: []EndpointPort{
+		{Name: "http", Port: 8080},
+		{Name: "metrics", Port: 9090},
+	}}
+
+	if p, ok := subsetPort(s, IntOrString{StrVal: "metrics"}); !ok || p != 9090 {
+		t.Logf("Named port not matched (%d)", p)
+		t.Fail()
+	}
+
+	if p, ok := subsetPort(s, IntOrString{IntVal: 8080}); !ok || p != 8080 {
+		t.Logf("Numbered port not matched (%d)", p)
+		t.Fail()
+	}
+
+	if _, ok := subsetPort(s, IntOrString{IntVal: 80}); ok {
+		t.Log("Ambiguous numbered port matched")
+		t.Fail()
+	}
+}
+
+func TestDesiredRoutesPaths(t *testing.T) {
+	var i Ingress
+	err := json.Unmarshal([]byte(`{
+		"metadata": {"name": "web", "namespace": "default"},
+		"spec": {"rules": [{"host": "example.com", "http": {"paths": [
+			{"path": "/", "backend": {"serviceName": "web", "servicePort": 8080}},
+			{"path": "/api/", "backend": {"serviceName": "web", "servicePort": 8080}}
+		]}}]}
+	}`), &i)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ks := &KubernetesSource{
+		ingresses: map[string]Ingress{"default/web": i},
+		endpoints: map[string]Endpoints{"default/web": {
+			Subsets: []EndpointSubset{{
+				Addresses: []EndpointAddress{{IP: "10.0.0.1"}},
+				Ports:     []EndpointPort{{Port: 8080}},
+			}},
+		}},
+	}
+
+	rs := ks.desiredRoutes()
+	if len(rs) != 2 || len(rs["example.com"]) != 1 || len(rs["example.com/api"]) != 1 {
+		t.Logf("Unexpected routes %v", rs)
+		t.Fail()
+	}
+}
+
+func TestDesiredRoutesDefaultBackend(t *testing.T) {
+	var i Ingress
+	err := json.Unmarshal([]byte(`{
+		"metadata": {"name": "web", "namespace": "default"},
+		"spec": {
+			"defaultBackend": {"service": {"name": "web", "port": {"number": 8080}}},
+			"rules": [{"host": "example.com"}]
+		}
+	}`), &i)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ks := &KubernetesSource{
+		ingresses: map[string]Ingress{"default/web": i},
+		endpoints: map[string]Endpoints{"default/web": {
+			Subsets: []EndpointSubset{{
+				Addresses: []EndpointAddress{{IP: "10.0.0.1"}},
+				Ports:     []EndpointPort{{Port: 8080}},
+			}},
+		}},
+	}
+
+	rs := ks.desiredRoutes()
+	if len(rs) != 1 || len(rs["example.com"]) != 1 {
+		t.Logf("Unexpected routes %v", rs)
+		t.Fail()
+	}
+}
@@ -1,20 +1,27 @@
 package sources
 
 import (
+	"context"
 	"github.com/3onyc/hipdate/shared"
 	"sync"
 )
 
+// Source sends the changes to the routes it watches on the channel it was
+// created with. Start runs it until ctx is done and returns nil once it has
+// cleaned up, or returns an error if it can't run at all.
 type Source interface {
-	Start()
-	Stop()
+	Start(ctx context.Context) error
+}
+
+// Reloader is implemented by sources that can apply changed options in place
+// on a config reload, instead of being stopped and started again.
+type Reloader interface {
+	Reload(opt shared.OptionMap) error
 }
 
 type SourceInitFunc func(
 	opt shared.OptionMap,
 	cce chan *shared.ChangeEvent,
-	wg *sync.WaitGroup,
-	sc chan bool,
 ) (
 	Source,
 	error,
@@ -27,3 +34,47 @@ var (
 func init() {
 	SourceMap = make(map[string]SourceInitFunc)
 }
+
+// Status is the state a source reports, Synced is set once the initial sync
+// has been sent, Err while the source can't reach whatever it's watching.
+type Status struct {
+	Synced bool
+	Err    error
+}
+
+// StatusReporter is implemented by sources that report their status, sources
+// that don't are considered synced once started.
+type StatusReporter interface {
+	Status() Status
+}
+
+// StatusTracker implements StatusReporter for sources embedding it.
+type StatusTracker struct {
+	mu sync.Mutex
+	s  Status
+}
+
+func NewStatusTracker() *StatusTracker {
+	return &StatusTracker{}
+}
+
+func (st *StatusTracker) Status() Status {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	return st.s
+}
+
+func (st *StatusTracker) SetSynced() {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	st.s.Synced = true
+}
+
+func (st *StatusTracker) SetError(err error) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	st.s.Err = err
+}
@@ -0,0 +1,181 @@
+package static
+
+import (
+	"context"
+	"errors"
+	"github.com/3onyc/hipdate/shared"
+	"github.com/3onyc/hipdate/sources"
+	"log"
+	"strings"
+	"sync"
+)
+
+var (
+	MissingHostsError = errors.New("no hosts specified")
+)
+
+// StaticSource routes fixed upstreams straight from its options, every option
+// maps a hostname to a comma separated list of endpoint URLs, e.g.
+//
+//	static:example.com=http://10.0.0.1:80,http://10.0.0.2:80
+//
+// Events are sent in the background, sent is closed once the last batch was
+// handed over.
+type StaticSource struct {
+	*sources.StatusTracker
+	cce  chan *shared.ChangeEvent
+	hl   shared.HostList
+	mu   sync.Mutex
+	ctx  context.Context
+	sent chan struct{}
+}
+
+func NewStaticSource(
+	opt shared.OptionMap,
+	cce chan *shared.ChangeEvent,
+) (
+	sources.Source,
+	error,
+) {
+	hl, err := parseHosts(opt)
+	if err != nil {
+		return nil, err
+	}
+
+	return &StaticSource{
+		StatusTracker: sources.NewStatusTracker(),
+		cce:           cce,
+		hl:            hl,
+	}, nil
+}
+
+func (ss *StaticSource) Start(ctx context.Context) error {
+	log.Println("NOTICE [source:static] Starting...")
+	ss.mu.Lock()
+	ss.ctx = ctx
+	ss.update(shared.HostList{}, ss.hl)
+	ss.mu.Unlock()
+	ss.SetSynced()
+
+	<-ctx.Done()
+
+	// The channel is closed once Start returns, so wait for the pending sends
+	ss.mu.Lock()
+	sent := ss.sent
+	ss.mu.Unlock()
+	if sent != nil {
+		<-sent
+	}
+
+	log.Println("NOTICE [source:static] Stopped")
+	return nil
+}
+
+// Reload replaces the configured hosts, only sending events for the
+// endpoints that were actually added or removed. It doesn't wait for the
+// events to be received, since it's called from the event loop receiving
+// them.
+func (ss *StaticSource) Reload(opt shared.OptionMap) error {
+	hl, err := parseHosts(opt)
+	if err != nil {
+		return err
+	}
+
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+
+	ss.update(ss.hl, hl)
+	ss.hl = hl
+
+	return nil
+}
+
+func (ss *StaticSource) update(old, new shared.HostList) {
+	evs := []*shared.ChangeEvent{}
+	for h, eps := range old {
+		for _, ep := range eps {
+			if !hasEndpoint(new[h], ep) {
+				evs = append(evs, shared.NewChangeEvent(shared.EventRemove, h, ep))
+			}
+		}
+	}
+
+	for h, eps := range new {
+		for _, ep := range eps {
+			if !hasEndpoint(old[h], ep) {
+				evs = append(evs, shared.NewChangeEvent(shared.EventAdd, h, ep))
+			}
+		}
+	}
+
+	if len(evs) > 0 {
+		ss.send(shared.NewBatchEvent(evs))
+	}
+}
+
+// send sends a batch after the previous ones, giving up once the source is
+// stopped. Before the source is started there's nothing to send, Start sends
+// all the hosts.
+func (ss *StaticSource) send(ce *shared.ChangeEvent) {
+	if ss.ctx == nil || ss.ctx.Err() != nil {
+		return
+	}
+
+	ctx, prev, done := ss.ctx, ss.sent, make(chan struct{})
+	ss.sent = done
+
+	go func() {
+		defer close(done)
+		if prev != nil {
+			<-prev
+		}
+
+		select {
+		case ss.cce <- ce:
+		case <-ctx.Done():
+		}
+	}()
+}
+
+func hasEndpoint(eps []shared.Endpoint, e shared.Endpoint) bool {
+	for _, ep := range eps {
+		if ep == e {
+			return true
+		}
+	}
+
+	return false
+}
+
+func parseHosts(opt shared.OptionMap) (shared.HostList, error) {
+	if len(opt) == 0 {
+		return nil, MissingHostsError
+	}
+
+	hl := shared.HostList{}
+	for h, us := range opt {
+		eps := []shared.Endpoint{}
+		for _, u := range strings.Split(us, ",") {
+			if u = strings.TrimSpace(u); u == "" {
+				continue
+			}
+
+			ep, err := shared.NewEndpointFromUrl(u)
+			if err != nil {
+				return nil, err
+			}
+
+			if !hasEndpoint(eps, *ep) {
+				eps = append(eps, *ep)
+			}
+		}
+
+		hl[shared.ParseHost(h)] = eps
+	}
+
+	return hl, nil
+}
+
+func init() {
+	sources.SourceMap["static"] = NewStaticSource
+}
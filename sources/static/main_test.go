@@ -0,0 +1,135 @@
+package static
+
+import (
+	"context"
+	"github.com/3onyc/hipdate/shared"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseHosts(t *testing.T) {
+	hl, err := parseHosts(shared.OptionMap{
+		"example.com": "http://10.0.0.1:80, http://10.0.0.2:8080,http://10.0.0.1:80",
+		"foo.com":     "https://10.0.0.3:443",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(hl["example.com"]) != 2 {
+		t.Logf("Expected 2 endpoints for example.com, got %v", hl["example.com"])
+		t.Fail()
+	}
+
+	if len(hl["foo.com"]) != 1 || hl["foo.com"][0].Scheme != "https" {
+		t.Logf("Unexpected endpoints for foo.com %v", hl["foo.com"])
+		t.Fail()
+	}
+}
+
+func TestParseHostsTags(t *testing.T) {
+	hl, err := parseHosts(shared.OptionMap{
+		"example.com": "http://10.0.0.1:80?tags=canary&tags=eu, http://10.0.0.2:80?tags=eu",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	eps := hl["example.com"]
+	if len(eps) != 2 || eps[0].Tags != "canary,eu" || eps[1].Tags != "eu" {
+		t.Logf("Unexpected endpoints %+v", eps)
+		t.Fail()
+	}
+}
+
+func TestParseHostsInvalid(t *testing.T) {
+	if _, err := parseHosts(shared.OptionMap{}); err != MissingHostsError {
+		t.Fail()
+	}
+
+	if _, err := parseHosts(shared.OptionMap{"foo.com": "http://10.0.0.1"}); err == nil {
+		t.Log("URL without port was accepted")
+		t.Fail()
+	}
+}
+
+func TestReloadOnlySendsChanges(t *testing.T) {
+	cce := make(chan *shared.ChangeEvent)
+	src, err := NewStaticSource(shared.OptionMap{
+		"example.com": "http://10.0.0.1:80,http://10.0.0.2:80",
+		"foo.com":     "http://10.0.0.3:80",
+	}, cce)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go src.Start(ctx)
+
+	if ce := <-cce; len(ce.Events) != 3 {
+		t.Logf("Expected 3 initial events, got %d", len(ce.Events))
+		t.Fail()
+	}
+
+	err = src.(*StaticSource).Reload(shared.OptionMap{
+		"example.com": "http://10.0.0.1:80,http://10.0.0.4:80",
+		"foo.com":     "http://10.0.0.3:80",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	evs := map[string]bool{}
+	for _, sce := range (<-cce).Events {
+		evs[sce.Type.String()+" "+string(sce.Host)+" "+sce.Endpoint.String()] = true
+	}
+
+	if len(evs) != 2 || !evs["remove example.com http://10.0.0.2:80"] || !evs["add example.com http://10.0.0.4:80"] {
+		t.Logf("Unexpected events %v", evs)
+		t.Fail()
+	}
+}
+
+// Reload is called from the event loop, so it mustn't wait for the events to
+// be received.
+func TestReloadDoesntBlock(t *testing.T) {
+	cce := make(chan *shared.ChangeEvent)
+	src, err := NewStaticSource(shared.OptionMap{"example.com": "http://10.0.0.1:80"}, cce)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	stopped := make(chan struct{})
+	go func() {
+		src.Start(ctx)
+		close(stopped)
+	}()
+
+	hosts := []string{(<-cce).Events[0].Endpoint.Address}
+	for _, u := range []string{"http://10.0.0.2:80", "http://10.0.0.3:80"} {
+		if err := src.(*StaticSource).Reload(shared.OptionMap{"example.com": u}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for i := 0; i < 2; i++ {
+		ce := <-cce
+		hosts = append(hosts, ce.Events[len(ce.Events)-1].Endpoint.Address)
+	}
+	if strings.Join(hosts, " ") != "10.0.0.1 10.0.0.2 10.0.0.3" {
+		t.Logf("Batches sent out of order %v", hosts)
+		t.Fail()
+	}
+
+	src.(*StaticSource).Reload(shared.OptionMap{"example.com": "http://10.0.0.4:80"})
+	cancel()
+
+	select {
+	case <-stopped:
+	case <-time.After(2 * time.Second):
+		t.Fatal("Source didn't stop with a batch pending")
+	}
+}